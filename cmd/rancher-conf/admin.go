@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runnerStatus describes the state of the runner. It is updated while
+// templates are processed and served by the admin API.
+type runnerStatus struct {
+	mu sync.RWMutex
+
+	// set once the first metadata version has been processed
+	Ready     bool      `json:"ready"`
+	Version   string    `json:"version"`
+	LastCycle time.Time `json:"last_cycle"`
+	// references between metadata objects that could not be resolved in
+	// the last cycle
+	Inconsistencies []string `json:"inconsistencies,omitempty"`
+	// statistics of the last cycle
+	LastSummary *cycleSummary     `json:"last_summary,omitempty"`
+	Templates   []*templateStatus `json:"templates"`
+}
+
+// templateStatus describes the state of a single template.
+type templateStatus struct {
+	Source     string    `json:"source"`
+	Dest       string    `json:"dest"`
+	LastUpdate time.Time `json:"last_update"`
+	LastError  string    `json:"last_error,omitempty"`
+	// number of notify runs that failed after all retries since the last
+	// successful one
+	NotifyFailures int `json:"notify_failures"`
+	// total number of notify retries
+	NotifyRetries int `json:"notify_retries"`
+	// set if the destination has been updated but the notify command did
+	// not succeed yet
+	NotifyPending bool `json:"notify_pending"`
+	// set if the last write was refused because the disk is nearly full
+	LowDiskSpace bool `json:"low_disk_space"`
+}
+
+func newRunnerStatus(templates []Template) *runnerStatus {
+	status := &runnerStatus{}
+	for _, t := range templates {
+		paths := make([]string, 0)
+		for _, d := range t.destinations() {
+			paths = append(paths, d.Path)
+		}
+		status.Templates = append(status.Templates, &templateStatus{Source: t.Source, Dest: strings.Join(paths, ",")})
+	}
+	return status
+}
+
+// update calls fn with the status locked for writing.
+func (s *runnerStatus) update(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn()
+}
+
+// pendingNotify returns the indexes of templates whose notify command has
+// to be retried.
+func (s *runnerStatus) pendingNotify() []int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pending := make([]int, 0)
+	for i, t := range s.Templates {
+		if t.NotifyPending {
+			pending = append(pending, i)
+		}
+	}
+	return pending
+}
+
+// notifyPending returns true if the notify command of the template has to
+// be retried.
+func (s *runnerStatus) notifyPending(t *templateStatus) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return t.NotifyPending
+}
+
+// serveReady responds with 200 once the first metadata version has been
+// processed and with 503 before, e.g. while the metadata service is
+// unavailable.
+func (s *runnerStatus) serveReady(w http.ResponseWriter, req *http.Request) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.Ready {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+func (s *runnerStatus) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		log.Warnf("Could not encode status: %v", err)
+	}
+}
+
+// serveMetrics writes the status in the Prometheus text format.
+func (s *runnerStatus) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP rancher_conf_last_cycle_timestamp_seconds Time of the last processed metadata version.")
+	fmt.Fprintln(w, "# TYPE rancher_conf_last_cycle_timestamp_seconds gauge")
+	fmt.Fprintf(w, "rancher_conf_last_cycle_timestamp_seconds %d\n", unixTime(s.LastCycle))
+
+	fmt.Fprintln(w, "# HELP rancher_conf_ready Whether the first metadata version has been processed.")
+	fmt.Fprintln(w, "# TYPE rancher_conf_ready gauge")
+	ready := 0
+	if s.Ready {
+		ready = 1
+	}
+	fmt.Fprintf(w, "rancher_conf_ready %d\n", ready)
+
+	fmt.Fprintln(w, "# HELP rancher_conf_metadata_inconsistencies Unresolved references between metadata objects in the last cycle.")
+	fmt.Fprintln(w, "# TYPE rancher_conf_metadata_inconsistencies gauge")
+	fmt.Fprintf(w, "rancher_conf_metadata_inconsistencies %d\n", len(s.Inconsistencies))
+
+	if sum := s.LastSummary; sum != nil {
+		cycleMetrics := []struct {
+			name, help string
+			value      float64
+		}{
+			{"rancher_conf_last_cycle_duration_seconds", "Duration of the last cycle.", sum.Duration},
+			{"rancher_conf_last_cycle_rendered", "Templates rendered in the last cycle.", float64(sum.Rendered)},
+			{"rancher_conf_last_cycle_skipped", "Templates skipped in the last cycle.", float64(sum.Skipped)},
+			{"rancher_conf_last_cycle_failed", "Templates failed in the last cycle.", float64(sum.Failed)},
+			{"rancher_conf_last_cycle_bytes_written", "Bytes written to destinations in the last cycle.", float64(sum.BytesWritten)},
+			{"rancher_conf_last_cycle_notified", "Notify commands run in the last cycle.", float64(sum.Notified)},
+		}
+		for _, m := range cycleMetrics {
+			fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+			fmt.Fprintf(w, "# TYPE %s gauge\n", m.name)
+			fmt.Fprintf(w, "%s %g\n", m.name, m.value)
+		}
+	}
+
+	metrics := []struct {
+		name, help, typ string
+		value           func(*templateStatus) int64
+	}{
+		{"rancher_conf_template_last_update_timestamp_seconds", "Time the destination was last updated.", "gauge",
+			func(t *templateStatus) int64 { return unixTime(t.LastUpdate) }},
+		{"rancher_conf_template_notify_failures", "Notify runs that failed after all retries since the last successful one.", "gauge",
+			func(t *templateStatus) int64 { return int64(t.NotifyFailures) }},
+		{"rancher_conf_template_notify_retries_total", "Retries of notify commands.", "counter",
+			func(t *templateStatus) int64 { return int64(t.NotifyRetries) }},
+		{"rancher_conf_template_notify_pending", "Whether the notify command has to be retried.", "gauge",
+			func(t *templateStatus) int64 {
+				if t.NotifyPending {
+					return 1
+				}
+				return 0
+			}},
+		{"rancher_conf_template_low_disk_space", "Whether the last write was refused because the disk is nearly full.", "gauge",
+			func(t *templateStatus) int64 {
+				if t.LowDiskSpace {
+					return 1
+				}
+				return 0
+			}},
+	}
+
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+		for _, t := range s.Templates {
+			fmt.Fprintf(w, "%s{source=%q,dest=%q} %d\n", m.name, t.Source, t.Dest, m.value(t))
+		}
+	}
+}
+
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// startAdminServer serves the status of the runner on /status as JSON, on
+// /metrics in the Prometheus text format and its readiness on /ready.
+func startAdminServer(addr string, status *runnerStatus) {
+	mux := http.NewServeMux()
+	mux.Handle("/status", status)
+	mux.HandleFunc("/metrics", status.serveMetrics)
+	mux.HandleFunc("/ready", status.serveReady)
+
+	log.Infof("Serving admin API on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("Admin API failed: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// auditLog appends a JSON encoded auditRecord for every rendered template
+// to a file.
+type auditLog struct {
+	file *os.File
+	host string
+}
+
+// auditRecord describes the processing of a template for a metadata
+// version.
+type auditRecord struct {
+	Time         time.Time          `json:"time"`
+	Host         string             `json:"host"`
+	Version      string             `json:"version"`
+	Template     string             `json:"template"`
+	Changed      bool               `json:"changed"`
+	Destinations []auditDestination `json:"destinations,omitempty"`
+	Commands     []auditCommand     `json:"commands,omitempty"`
+	Error        string             `json:"error,omitempty"`
+}
+
+// auditDestination describes a write to a destination. The old hash and
+// size are empty for remote destinations and new files.
+type auditDestination struct {
+	Path         string `json:"path"`
+	OldHash      string `json:"old_hash,omitempty"`
+	NewHash      string `json:"new_hash"`
+	OldSize      int    `json:"old_size"`
+	NewSize      int    `json:"new_size"`
+	BytesChanged int    `json:"bytes_changed"`
+}
+
+// auditCommand describes a command execution.
+type auditCommand struct {
+	Stage    string `json:"stage"`
+	Command  string `json:"command"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	return &auditLog{file: file, host: host}, nil
+}
+
+// newRecord returns a record for the processing of a template. It returns
+// nil if the audit log is disabled, all methods of auditRecord are no-ops
+// on nil records.
+func (a *auditLog) newRecord(version string, t Template) *auditRecord {
+	if a == nil {
+		return nil
+	}
+	return &auditRecord{Time: time.Now().UTC(), Host: a.host, Version: version, Template: t.Source}
+}
+
+// write appends the record to the audit log.
+func (a *auditLog) write(rec *auditRecord) {
+	if a == nil || rec == nil {
+		return
+	}
+
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		log.Warnf("Could not encode audit record: %v", err)
+		return
+	}
+	if _, err := a.file.Write(append(buf, '\n')); err != nil {
+		log.Warnf("Could not write audit log: %v", err)
+	}
+}
+
+// destination records a write of content to a destination whose previous
+// content was old.
+func (rec *auditRecord) destination(path string, old, content []byte) {
+	if rec == nil {
+		return
+	}
+
+	d := auditDestination{
+		Path:         path,
+		NewHash:      sha256Hex(content),
+		OldSize:      len(old),
+		NewSize:      len(content),
+		BytesChanged: bytesChanged(old, content),
+	}
+	if old != nil {
+		d.OldHash = sha256Hex(old)
+	}
+
+	rec.Changed = true
+	rec.Destinations = append(rec.Destinations, d)
+}
+
+// command records the execution of a command and its result.
+func (rec *auditRecord) command(stage, command string, err error) {
+	if rec == nil {
+		return
+	}
+
+	c := auditCommand{Stage: stage, Command: secrets.redact(command)}
+	if err != nil {
+		c.Error = secrets.redact(err.Error())
+		c.ExitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			c.ExitCode = exitErr.ExitCode()
+		}
+	}
+
+	rec.Commands = append(rec.Commands, c)
+}
+
+// fail records the error the processing of the template failed with.
+func (rec *auditRecord) fail(err error) {
+	if rec == nil || err == nil {
+		return
+	}
+	rec.Error = secrets.redact(err.Error())
+}
+
+// bytesChanged returns the number of bytes that differ between old and
+// new, comparing them position by position.
+func bytesChanged(old, new []byte) int {
+	changed := 0
+	for i := 0; i < len(old) && i < len(new); i++ {
+		if old[i] != new[i] {
+			changed++
+		}
+	}
+	if len(old) > len(new) {
+		return changed + len(old) - len(new)
+	}
+	return changed + len(new) - len(old)
+}
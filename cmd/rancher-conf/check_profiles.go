@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// checkProfiles are the built-in checks selected with the check option of
+// a template. The placeholder {{config}} is replaced with the path of the
+// main configuration file in the temporary configuration tree.
+var checkProfiles = map[string][]string{
+	"nginx":      {"nginx", "-t", "-q", "-c", "{{config}}"},
+	"haproxy":    {"haproxy", "-c", "-q", "-f", "{{config}}"},
+	"prometheus": {"promtool", "check", "config", "{{config}}"},
+}
+
+// maxRewriteSize limits the size of files in which paths are rewritten.
+const maxRewriteSize = 1 << 20
+
+// checkDirPrefix is the prefix of the directories the configuration tree
+// is copied to.
+const checkDirPrefix = "rancher-conf-check-"
+
+// checkTarget returns the local destination checked by the check profile
+// of the template.
+func (t Template) checkTarget() string {
+	for _, d := range t.destinations() {
+		if !isRemoteDestination(d.Path) {
+			return d.Path
+		}
+	}
+	return ""
+}
+
+// checkProfileConfig validates the check profile options of a template.
+func checkProfileConfig(t Template) error {
+	if t.Check == "" {
+		return nil
+	}
+	if _, ok := checkProfiles[t.Check]; !ok {
+		return fmt.Errorf("Unknown check profile '%s'", t.Check)
+	}
+	if t.checkTarget() == "" {
+		return fmt.Errorf("Check profile '%s' requires a local destination", t.Check)
+	}
+	// the tree is copied for every check, so it must not default to a
+	// directory like /etc
+	if t.CheckRoot == "" {
+		return fmt.Errorf("Check profile '%s' requires check-root", t.Check)
+	}
+	return nil
+}
+
+// runCheckProfile checks content with the check profile of the template.
+//
+// The configuration tree below check-root is copied into a temporary
+// directory and the destination is replaced with the content, so the main
+// configuration and all relative includes are checked as they will be
+// after the update. Absolute paths into check-root are rewritten to the
+// temporary tree in all text files of the copy.
+func runCheckProfile(t Template, content []byte, stagingDir string) (string, error) {
+	target, err := filepath.Abs(t.checkTarget())
+	if err != nil {
+		return "", err
+	}
+	root, err := filepath.Abs(t.CheckRoot)
+	if err != nil {
+		return "", err
+	}
+	config := target
+	if t.CheckConfig != "" {
+		if config, err = filepath.Abs(t.CheckConfig); err != nil {
+			return "", err
+		}
+	}
+
+	relTarget, err := relativeToRoot(root, target)
+	if err != nil {
+		return "", err
+	}
+	relConfig, err := relativeToRoot(root, config)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempDir(stagingDir, checkDirPrefix)
+	if err != nil {
+		return "", fmt.Errorf("Could not create check directory: %v", err)
+	}
+	trackTemp(tmp)
+	defer removeTemp(tmp)
+	// commands may run as another user
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return "", err
+	}
+
+	rewrite := func(buf []byte) []byte {
+		return bytes.Replace(buf, []byte(root+string(filepath.Separator)), []byte(tmp+string(filepath.Separator)), -1)
+	}
+
+	// the check directory and other staging files may be below root
+	skip := []string{tmp}
+	if stagingDir != "" {
+		if dir, err := filepath.Abs(stagingDir); err == nil {
+			skip = append(skip, dir)
+		}
+	}
+
+	log.Debugf("Copying configuration tree %s to %s", root, tmp)
+	if err := copyTree(root, tmp, skip, rewrite); err != nil {
+		return "", fmt.Errorf("Could not copy configuration tree %s: %v", root, err)
+	}
+
+	dest := filepath.Join(tmp, relTarget)
+	os.Remove(dest)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(dest, rewrite(content), 0644); err != nil {
+		return "", err
+	}
+
+	argv := make([]string, 0)
+	for _, arg := range checkProfiles[t.Check] {
+		argv = append(argv, strings.Replace(arg, "{{config}}", filepath.Join(tmp, relConfig), -1))
+	}
+	command := Command{Argv: argv}
+
+	log.Debugf("Running check profile %s: '%s'", t.Check, command)
+	cmd, err := newCommand(t, command)
+	if err != nil {
+		return command.String(), err
+	}
+	cmd.Dir = tmp
+
+	out, err := childCombinedOutput(cmd)
+	if err != nil {
+		// report paths of the real configuration tree
+		out = bytes.Replace(out, []byte(tmp), []byte(root), -1)
+		logCmdOutput(command.String(), out)
+		return command.String(), &commandError{Err: err, Output: out}
+	}
+
+	return command.String(), nil
+}
+
+func relativeToRoot(root, path string) (string, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not below check-root %s", path, root)
+	}
+	return rel, nil
+}
+
+// copyTree copies the directory tree src to dst, leaving out the
+// directories in skip. Symlinks are copied as links. rewrite is applied to
+// the content of text files and the targets of links.
+func copyTree(src, dst string, skip []string, rewrite func([]byte) []byte) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && containsString(skip, path) {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(string(rewrite([]byte(link))), target)
+		case info.Mode().IsRegular():
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if len(buf) <= maxRewriteSize && bytes.IndexByte(buf, 0) < 0 {
+				buf = rewrite(buf)
+			}
+			return ioutil.WriteFile(target, buf, info.Mode().Perm())
+		}
+		// sockets, devices and pipes are not needed by configuration checks
+		return nil
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tempFiles tracks the staging files and directories that exist while
+// templates are processed, so they can be removed if the process is
+// terminated by a signal.
+var tempFiles = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+// promoteLock is held while staging files are promoted to their
+// destinations, so a signal doesn't terminate the process in the middle of
+// a copy.
+var promoteLock sync.Mutex
+
+// trackTemp registers a temporary file or directory for removal on
+// termination.
+func trackTemp(path string) {
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+	tempFiles.paths[path] = true
+}
+
+// removeTemp removes a temporary file or directory and stops tracking it.
+func removeTemp(path string) error {
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+	delete(tempFiles.paths, path)
+	return os.RemoveAll(path)
+}
+
+// removeTempFiles removes all tracked temporary files and directories.
+func removeTempFiles() {
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+	for path := range tempFiles.paths {
+		log.Debugf("Removing %s", path)
+		if err := os.RemoveAll(path); err != nil {
+			log.Warnf("Could not remove %s: %v", path, err)
+		}
+		delete(tempFiles.paths, path)
+	}
+}
+
+// handleSignals removes temporary files and releases the lock when the
+// process is terminated by SIGINT, SIGTERM or SIGHUP, and exits with 128
+// plus the number of the signal. SIGQUIT keeps its default behavior of
+// dumping the goroutines.
+func handleSignals(lock *instanceLock) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	go func() {
+		sig := <-signals
+		log.Infof("Received %v. Cleaning up", sig)
+
+		// wait for a destination that is being written
+		promoteLock.Lock()
+		removeTempFiles()
+		lock.Release()
+
+		code := 1
+		if s, ok := sig.(syscall.Signal); ok {
+			code = 128 + int(s)
+		}
+		os.Exit(code)
+	}()
+}
+
+// cleanupCheckDirs removes the directories of check profiles left behind by
+// previous runs. They are only searched in a configured staging directory,
+// as the system's temporary directory may be shared with other instances.
+func cleanupCheckDirs(stagingDir string) {
+	if stagingDir == "" {
+		return
+	}
+
+	matches, err := filepath.Glob(filepath.Join(stagingDir, checkDirPrefix+"*"))
+	if err != nil {
+		return
+	}
+	for _, match := range matches {
+		log.Infof("Removing orphaned check directory %s", match)
+		if err := os.RemoveAll(match); err != nil {
+			log.Warnf("Could not remove orphaned check directory %s: %v", match, err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Command is a command configured for a template. A string is executed by
+// the shell, a list is used as argument vector and executed directly.
+//
+//	notify-cmd = "nginx -s reload"
+//	notify-cmd = ["/usr/sbin/nginx", "-s", "reload"]
+type Command struct {
+	Line string
+	Argv []string
+}
+
+// UnmarshalTOML implements toml.Unmarshaler.
+func (c *Command) UnmarshalTOML(data interface{}) error {
+	switch typed := data.(type) {
+	case string:
+		c.Line = typed
+	case []interface{}:
+		c.Argv = make([]string, 0, len(typed))
+		for _, item := range typed {
+			arg, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("command arguments must be strings, got %T", item)
+			}
+			c.Argv = append(c.Argv, arg)
+		}
+	default:
+		return fmt.Errorf("command must be a string or a list of strings, got %T", data)
+	}
+	return nil
+}
+
+// IsEmpty returns true if no command is configured.
+func (c Command) IsEmpty() bool {
+	return c.Line == "" && len(c.Argv) == 0
+}
+
+// Replace returns a copy of the command with all occurrences of old
+// replaced by new.
+func (c Command) Replace(old, new string) Command {
+	r := Command{Line: strings.Replace(c.Line, old, new, -1)}
+	for _, arg := range c.Argv {
+		r.Argv = append(r.Argv, strings.Replace(arg, old, new, -1))
+	}
+	return r
+}
+
+func (c Command) String() string {
+	if len(c.Argv) > 0 {
+		return strings.Join(c.Argv, " ")
+	}
+	return c.Line
+}
+
+// Fields returns the argument vector of the command, splitting a command
+// line on white space.
+func (c Command) Fields() []string {
+	if len(c.Argv) > 0 {
+		return c.Argv
+	}
+	return strings.Fields(c.Line)
+}
+
+// commandError is returned if a command failed. It carries the combined
+// output of the command.
+type commandError struct {
+	Err    error
+	Output []byte
+}
+
+func (e *commandError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *commandError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strings"
+)
+
+const compressGzip = "gzip"
+
+// compressContent compresses rendered content with the given method. The
+// gzip header doesn't contain a name or modification time, so the same
+// content always results in the same output and unchanged destinations are
+// still detected.
+func compressContent(content []byte, method string) ([]byte, error) {
+	switch strings.ToLower(method) {
+	case "":
+		return content, nil
+	case compressGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(content); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("Unknown compression '%s'", method)
+	}
+}
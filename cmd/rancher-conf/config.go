@@ -5,30 +5,149 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	log "github.com/sirupsen/logrus"
 )
 
 type Config struct {
-	Interval        int        `toml:"interval"`
-	MetadataVersion string     `toml:"metadata-version"`
-	LogLevel        string     `toml:"log-level"`
-	OneTime         bool       `toml:"onetime"`
-	IncludeInactive bool       `toml:"include-inactive"`
-	MetadataUrl     string     `toml:"metadata-url"`
-	Templates       []Template `toml:"template"`
-	SelfId          string
+	Interval          int        `toml:"interval"`
+	MetadataVersion   string     `toml:"metadata-version"`
+	LogLevel          string     `toml:"log-level"`
+	OneTime           bool       `toml:"onetime"`
+	ChangedExitCode   int        `toml:"changed-exit-code"`
+	MaxFailures       int        `toml:"max-failures"`
+	ExitOnError       []string   `toml:"exit-on-error"`
+	IncludeInactive   bool       `toml:"include-inactive"`
+	RequireConsistent bool       `toml:"require-consistent"`
+	MetadataUrl       string     `toml:"metadata-url"`
+	JsonnetPath       string     `toml:"jsonnet-path"`
+	ContextScript     string     `toml:"context-script"`
+	AlwaysRender      bool       `toml:"always-render"`
+	StagingDir        string     `toml:"staging-dir"`
+	Shell             Command    `toml:"shell"`
+	AdminAddr         string     `toml:"admin-addr"`
+	AuditLog          string     `toml:"audit-log"`
+	ReportWebhook     string     `toml:"report-webhook"`
+	SentryDSN         string     `toml:"sentry-dsn"`
+	LockFile          string     `toml:"lock-file"`
+	LockWait          int        `toml:"lock-wait"`
+	Vars              VarMap     `toml:"vars"`
+	TemplateLibDir    string     `toml:"template-lib-dir"`
+	MinFreeDisk       int        `toml:"min-free-disk"`
+	StartupSettle     int        `toml:"startup-settle"`
+	ExpectedServices  []string   `toml:"expected-services"`
+	Only              []string   `toml:"only"`
+	DestPrefix        string     `toml:"dest-prefix"`
+	Redact            []string   `toml:"redact"`
+	SnapshotDir       string     `toml:"snapshot-dir"`
+	SecretsDir        string     `toml:"secrets-dir"`
+	Subreaper         bool       `toml:"subreaper"`
+	MetadataWait      int        `toml:"metadata-wait"`
+	MetadataFallback  string     `toml:"metadata-unavailable"`
+	SnapshotKeep      int        `toml:"snapshot-keep"`
+	Skip              []string   `toml:"skip"`
+	Events            bool       `toml:"events"`
+	RancherUrl        string     `toml:"rancher-url"`
+	RancherAccessKey  string     `toml:"rancher-access-key"`
+	RancherSecretKey  string     `toml:"rancher-secret-key"`
+	NotifyConcurrency int        `toml:"notify-concurrency"`
+	ContextVersion    int        `toml:"context-version"`
+	BindMountWrites   string     `toml:"bind-mount-writes"`
+	WaitFor           string     `toml:"wait-for"`
+	WaitForTimeout    int        `toml:"wait-for-timeout"`
+	Manifest          string     `toml:"manifest"`
+	CleanupOrphans    bool       `toml:"cleanup-orphans"`
+	Templates         []Template `toml:"template"`
+	Plugins           []Plugin   `toml:"plugin"`
+	SelfId            string
+	// local destinations of all templates, including the ones disabled by
+	// only and skip, which must not be removed as orphans
+	OwnedPaths []string `toml:"-"`
+	// additional Rancher environments exposed as .Environments
+	Environments []RemoteEnvironment `toml:"environment"`
 }
 
 type Template struct {
-	Source       string `toml:"source"`
-	Dest         string `toml:"dest"`
-	UpdateCmd    string `toml:"version-cmd"`
-	CheckCmd     string `toml:"check-cmd"`
-	NotifyCmd    string `toml:"notify-cmd"`
-	NotifyOutput bool   `toml:"notify-output"`
+	Name          string        `toml:"name"`
+	Source        string        `toml:"source"`
+	Dest          string        `toml:"dest"`
+	Engine        string        `toml:"engine"`
+	Format        string        `toml:"format"`
+	Validate      string        `toml:"validate-format"`
+	Compress      string        `toml:"compress"`
+	UpdateCmd     Command       `toml:"version-cmd"`
+	PostProcess   Command       `toml:"post-process-cmd"`
+	CheckCmd      Command       `toml:"check-cmd"`
+	Check         string        `toml:"check"`
+	CheckRoot     string        `toml:"check-root"`
+	CheckConfig   string        `toml:"check-config"`
+	NotifyCmd     Command       `toml:"notify-cmd"`
+	NotifyOutput  bool          `toml:"notify-output"`
+	NotifyRetries int           `toml:"notify-retries"`
+	NotifyBackoff int           `toml:"notify-backoff"`
+	NotifyAfter   []string      `toml:"notify-after"`
+	ReloadUnit    string        `toml:"reload-unit"`
+	SELinuxLabel  string        `toml:"selinux-label"`
+	CommandUser   string        `toml:"command-user"`
+	CommandGroup  string        `toml:"command-group"`
+	CommandEnv    []string      `toml:"command-env"`
+	Shell         Command       `toml:"shell"`
+	Destinations  []Destination `toml:"destination"`
+	Stacks        []string      `toml:"stacks"`
+	Services      []string      `toml:"services"`
+	Vars          VarMap        `toml:"vars"`
+	Requires      []string      `toml:"require-services"`
+	RequireMode   string        `toml:"require-mode"`
+	Schema        *MetaSchema   `toml:"metadata-schema"`
+	EnabledWhen   string        `toml:"enabled-when-label"`
+	CtxVersion    int           `toml:"context-version"`
+	Watch         []string      `toml:"watch"`
+	MemoizeKey    string        `toml:"memoize-key"`
+}
+
+// VarMap contains variables exposed as .Vars in templates.
+type VarMap map[string]interface{}
+
+// Destination is an additional destination of a template. The rendered
+// content is written to all destinations of a template.
+type Destination struct {
+	Path  string `toml:"path"`
+	Mode  string `toml:"mode"`
+	Owner string `toml:"owner"`
+	Group string `toml:"group"`
+}
+
+// prefixPaths prepends prefix to the local destinations of the template
+// and to the paths of its check profile, which refer to the same tree.
+func (t *Template) prefixPaths(prefix string) {
+	join := func(p string) string {
+		if p == "" || isRemoteDestination(p) {
+			return p
+		}
+		// a drive letter can't be nested
+		return filepath.Join(prefix, strings.TrimPrefix(p, filepath.VolumeName(p)))
+	}
+
+	t.Dest = join(t.Dest)
+	for i := range t.Destinations {
+		t.Destinations[i].Path = join(t.Destinations[i].Path)
+	}
+	t.CheckRoot = join(t.CheckRoot)
+	t.CheckConfig = join(t.CheckConfig)
+}
+
+// destinations returns the dest of the template followed by its
+// additional destinations.
+func (t Template) destinations() []Destination {
+	dests := make([]Destination, 0, len(t.Destinations)+1)
+	if t.Dest != "" {
+		dests = append(dests, Destination{Path: t.Dest})
+	}
+	return append(dests, t.Destinations...)
 }
 
 func initConfig(configFile string) (*Config, error) {
@@ -37,6 +156,7 @@ func initConfig(configFile string) (*Config, error) {
 		MetadataUrl:     "http://rancher-metadata.rancher.internal",
 		Interval:        5,
 		LogLevel:        "info",
+		MetadataWait:    defaultMetadataWait,
 	}
 
 	if len(configFile) > 0 {
@@ -52,6 +172,94 @@ func initConfig(configFile string) (*Config, error) {
 	overwriteConfigFromEnv(&config)
 	overwriteConfigFromFlags(&config)
 
+	for i, tmpl := range config.Templates {
+		engine, err := templateEngine(tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("Template %s: %v", tmpl.Source, err)
+		}
+		if engine == engineJsonnet {
+			if err := checkJsonnetConfig(tmpl, config.JsonnetPath); err != nil {
+				return nil, fmt.Errorf("Template %s: %v", tmpl.Source, err)
+			}
+		}
+		for _, d := range tmpl.Destinations {
+			if d.Path == "" {
+				return nil, fmt.Errorf("Template %s: destination without path", tmpl.Source)
+			}
+			if _, err := strconv.ParseUint(d.Mode, 8, 32); d.Mode != "" && err != nil {
+				return nil, fmt.Errorf("Template %s: invalid mode '%s' for %s", tmpl.Source, d.Mode, d.Path)
+			}
+		}
+		if _, err := compressContent(nil, tmpl.Compress); err != nil {
+			return nil, fmt.Errorf("Template %s: %v", tmpl.Source, err)
+		}
+		if err := checkValidateFormat(tmpl.Validate); err != nil {
+			return nil, fmt.Errorf("Template %s: %v", tmpl.Source, err)
+		}
+		if err := checkProfileConfig(tmpl); err != nil {
+			return nil, fmt.Errorf("Template %s: %v", tmpl.Source, err)
+		}
+		if err := checkRequireMode(tmpl.RequireMode); err != nil {
+			return nil, fmt.Errorf("Template %s: %v", tmpl.Source, err)
+		}
+		if err := tmpl.Schema.check(); err != nil {
+			return nil, fmt.Errorf("Template %s: %v", tmpl.Source, err)
+		}
+		if err := checkContextVersion(tmpl.CtxVersion); err != nil {
+			return nil, fmt.Errorf("Template %s: %v", tmpl.Source, err)
+		}
+		if tmpl.Shell.IsEmpty() {
+			config.Templates[i].Shell = config.Shell
+		}
+	}
+
+	if config.DestPrefix != "" {
+		for i := range config.Templates {
+			config.Templates[i].prefixPaths(config.DestPrefix)
+		}
+	}
+	config.OwnedPaths = ownedPaths(config.Templates)
+
+	if err := checkNotifyOrder(config.Templates); err != nil {
+		return nil, err
+	}
+
+	templates, err := selectTemplates(config.Templates, config.Only, config.Skip)
+	if err != nil {
+		return nil, err
+	}
+	config.Templates = templates
+
+	if err := secrets.addPatterns(config.Redact); err != nil {
+		return nil, err
+	}
+
+	for _, stage := range config.ExitOnError {
+		if !containsString(append(stages, "any"), stage) {
+			return nil, fmt.Errorf("Invalid exit-on-error stage: %s", stage)
+		}
+	}
+
+	if config.CleanupOrphans && config.Manifest == "" {
+		return nil, fmt.Errorf("Option cleanup-orphans requires a manifest")
+	}
+
+	if err := checkContextVersion(config.ContextVersion); err != nil {
+		return nil, err
+	}
+
+	if err := checkMountWrites(config.BindMountWrites); err != nil {
+		return nil, err
+	}
+
+	if err := checkEnvironments(config.Environments); err != nil {
+		return nil, err
+	}
+
+	if err := checkMetadataUnavailable(config.MetadataFallback); err != nil {
+		return nil, err
+	}
+
 	if config.Interval == 0 {
 		return nil, fmt.Errorf("Interval must be greater than 0")
 	}
@@ -81,13 +289,28 @@ func setConfigFromFile(path string, conf *Config) error {
 }
 
 func setTemplateFromFlags(conf *Config) {
+	// without source, rancher-conf only waits for wait-for
+	if flag.NArg() < 1 {
+		return
+	}
+
 	tmpl := Template{
-		Source:       flag.Arg(0),
-		Dest:         flag.Arg(1),
-		CheckCmd:     checkCmd,
-		UpdateCmd:    updateCmd,
-		NotifyCmd:    notifyCmd,
-		NotifyOutput: notifyOutput,
+		Source:        flag.Arg(0),
+		Dest:          flag.Arg(1),
+		Engine:        engine,
+		Compress:      compress,
+		Validate:      validateFormat,
+		CheckCmd:      Command{Line: checkCmd},
+		PostProcess:   Command{Line: postProcessCmd},
+		Check:         checkProfile,
+		UpdateCmd:     Command{Line: updateCmd},
+		NotifyCmd:     Command{Line: notifyCmd},
+		NotifyOutput:  notifyOutput,
+		NotifyRetries: notifyRetries,
+		NotifyBackoff: notifyBackoff,
+		ReloadUnit:    reloadUnitName,
+		Stacks:        splitList(stacksFlag),
+		Services:      splitList(servicesFlag),
 	}
 	conf.Templates = []Template{tmpl}
 }
@@ -103,16 +326,117 @@ func overwriteConfigFromFlags(conf *Config) {
 			conf.MetadataVersion = metadataVersion
 		case "onetime":
 			conf.OneTime = onetime
+		case "changed-exit-code":
+			conf.ChangedExitCode = changedExitCode
+		case "max-failures":
+			conf.MaxFailures = maxFailures
+		case "exit-on-error":
+			conf.ExitOnError = splitList(exitOnError)
 		case "include-inactive":
 			conf.IncludeInactive = includeInactive
+		case "require-consistent":
+			conf.RequireConsistent = requireConsistent
 		case "log-level":
 			conf.LogLevel = logLevel
 		case "self":
 			conf.SelfId = selfId
+		case "context-script":
+			conf.ContextScript = contextScript
+		case "always-render":
+			conf.AlwaysRender = alwaysRender
+		case "staging-dir":
+			conf.StagingDir = stagingDir
+		case "template-lib-dir":
+			conf.TemplateLibDir = templateLibDir
+		case "min-free-disk":
+			conf.MinFreeDisk = minFreeDisk
+		case "startup-settle":
+			conf.StartupSettle = startupSettle
+		case "expected-services":
+			conf.ExpectedServices = splitList(expectedServices)
+		case "metadata-wait":
+			conf.MetadataWait = metadataWaitFlag
+		case "metadata-unavailable":
+			conf.MetadataFallback = metadataFallback
+		case "subreaper":
+			conf.Subreaper = subreaper
+		case "secrets-dir":
+			conf.SecretsDir = secretsDir
+		case "snapshot-dir":
+			conf.SnapshotDir = snapshotDir
+		case "snapshot-keep":
+			conf.SnapshotKeep = snapshotKeep
+		case "redact":
+			conf.Redact = append(conf.Redact, redactPatterns...)
+		case "dest-prefix":
+			conf.DestPrefix = destPrefix
+		case "only":
+			conf.Only = splitList(onlyTemplates)
+		case "skip":
+			conf.Skip = splitList(skipTemplates)
+		case "events":
+			conf.Events = events
+		case "wait-for":
+			conf.WaitFor = waitFor
+		case "wait-for-timeout":
+			conf.WaitForTimeout = waitForTimeout
+		case "bind-mount-writes":
+			conf.BindMountWrites = bindMountWrites
+		case "context-version":
+			conf.ContextVersion = contextVersion
+		case "notify-concurrency":
+			conf.NotifyConcurrency = notifyConcurrency
+		case "manifest":
+			conf.Manifest = manifestPath
+		case "cleanup-orphans":
+			conf.CleanupOrphans = cleanupOrphans
+		case "rancher-url":
+			conf.RancherUrl = rancherUrl
+		case "admin-addr":
+			conf.AdminAddr = adminAddr
+		case "audit-log":
+			conf.AuditLog = auditLogPath
+		case "report-webhook":
+			conf.ReportWebhook = reportWebhook
+		case "sentry-dsn":
+			conf.SentryDSN = sentryDSN
+		case "lock-file":
+			conf.LockFile = lockFile
+		case "lock-wait":
+			conf.LockWait = lockWait
+		case "shell":
+			conf.Shell = Command{Line: shell}
+		case "var":
+			if conf.Vars == nil {
+				conf.Vars = VarMap{}
+			}
+			for key, value := range vars {
+				conf.Vars[key] = value
+			}
 		}
 	})
 }
 
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma separated list, ignoring empty items.
+func splitList(s string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func overwriteConfigFromEnv(conf *Config) {
 	var env string
 	if env = os.Getenv("RANCHER_GEN_LOGLEVEL"); len(env) > 0 {
@@ -138,4 +462,65 @@ func overwriteConfigFromEnv(conf *Config) {
 	if env = os.Getenv("RANCHER_GEN_INACTIVE"); len(env) > 0 {
 		conf.IncludeInactive = true
 	}
+	if env = os.Getenv("RANCHER_GEN_REQUIRE_CONSISTENT"); len(env) > 0 {
+		conf.RequireConsistent = true
+	}
+	if env = os.Getenv("RANCHER_GEN_STAGING_DIR"); len(env) > 0 {
+		conf.StagingDir = env
+	}
+	if env = os.Getenv("RANCHER_GEN_SECRETS_DIR"); len(env) > 0 {
+		conf.SecretsDir = env
+	}
+	if env = os.Getenv("RANCHER_GEN_SNAPSHOT_DIR"); len(env) > 0 {
+		conf.SnapshotDir = env
+	}
+	if env = os.Getenv("RANCHER_GEN_WAIT_FOR"); len(env) > 0 {
+		conf.WaitFor = env
+	}
+	if env = os.Getenv("RANCHER_GEN_MANIFEST"); len(env) > 0 {
+		conf.Manifest = env
+	}
+	if env = os.Getenv("RANCHER_GEN_DEST_PREFIX"); len(env) > 0 {
+		conf.DestPrefix = env
+	}
+	if env = os.Getenv("RANCHER_GEN_ONLY"); len(env) > 0 {
+		conf.Only = splitList(env)
+	}
+	if env = os.Getenv("RANCHER_GEN_SKIP"); len(env) > 0 {
+		conf.Skip = splitList(env)
+	}
+	if env = os.Getenv("RANCHER_GEN_EVENTS"); len(env) > 0 {
+		conf.Events = true
+	}
+	// the variables Rancher sets for containers with API access
+	if env = os.Getenv("CATTLE_URL"); len(env) > 0 && conf.RancherUrl == "" {
+		conf.RancherUrl = env
+	}
+	if env = os.Getenv("CATTLE_ACCESS_KEY"); len(env) > 0 && conf.RancherAccessKey == "" {
+		conf.RancherAccessKey = env
+	}
+	if env = os.Getenv("CATTLE_SECRET_KEY"); len(env) > 0 && conf.RancherSecretKey == "" {
+		conf.RancherSecretKey = env
+	}
+	if env = os.Getenv("RANCHER_GEN_TEMPLATE_LIB_DIR"); len(env) > 0 {
+		conf.TemplateLibDir = env
+	}
+	if env = os.Getenv("RANCHER_GEN_ADMIN_ADDR"); len(env) > 0 {
+		conf.AdminAddr = env
+	}
+	if env = os.Getenv("RANCHER_GEN_AUDIT_LOG"); len(env) > 0 {
+		conf.AuditLog = env
+	}
+	if env = os.Getenv("RANCHER_GEN_REPORT_WEBHOOK"); len(env) > 0 {
+		conf.ReportWebhook = env
+	}
+	if env = os.Getenv("RANCHER_GEN_SENTRY_DSN"); len(env) > 0 {
+		conf.SentryDSN = env
+	}
+	if env = os.Getenv("RANCHER_GEN_LOCK_FILE"); len(env) > 0 {
+		conf.LockFile = env
+	}
+	if env = os.Getenv("RANCHER_GEN_SHELL"); len(env) > 0 {
+		conf.Shell = Command{Line: env}
+	}
 }
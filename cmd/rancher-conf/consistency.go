@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+)
+
+// consistencyReport lists the references between metadata objects that
+// could not be resolved while building the context, e.g. services of a
+// stack that is not listed yet while the stack is being upgraded.
+type consistencyReport struct {
+	Problems []string
+}
+
+func (r *consistencyReport) add(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// Consistent returns true if all references could be resolved.
+func (r *consistencyReport) Consistent() bool {
+	return len(r.Problems) == 0
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	log "github.com/sirupsen/logrus"
+	"go.starlark.net/starlark"
+)
+
+// runContextScript executes the configured Starlark script against the
+// context before any template is rendered. The script must define a function
+//
+//	def transform(ctx):
+//
+// that receives the exported context as a dict and returns either None or a
+// dict with the optional keys:
+//
+//	"filter": a dict with lists of "stacks" (names), "services"
+//	          ("service.stack"), "containers" and "hosts" (UUIDs) to keep
+//	"values": a dict of derived values exposed to templates via `derived`
+func runContextScript(path string, ctx *TemplateContext) error {
+	thread := &starlark.Thread{
+		Name: "context-script",
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Debugf("[%s]: %s", path, msg)
+		},
+	}
+
+	globals, err := starlark.ExecFile(thread, path, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	transform, ok := globals["transform"]
+	if !ok {
+		return fmt.Errorf("%s does not define a transform function", path)
+	}
+
+	exported, err := toGeneric(ctx.Export())
+	if err != nil {
+		return err
+	}
+
+	arg, err := toStarlark(exported)
+	if err != nil {
+		return err
+	}
+
+	ret, err := starlark.Call(thread, transform, starlark.Tuple{arg}, nil)
+	if err != nil {
+		return err
+	}
+
+	result, err := fromStarlark(ret)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+
+	m, ok := result.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("transform must return a dict or None, got %s", ret.Type())
+	}
+
+	if values, ok := m["values"].(map[string]interface{}); ok {
+		ctx.Derived = values
+	}
+
+	if filter, ok := m["filter"].(map[string]interface{}); ok {
+		keep := make(map[string]map[string]bool)
+		for _, key := range []string{"stacks", "services", "containers", "hosts"} {
+			list, ok := filter[key]
+			if !ok {
+				continue
+			}
+			items, ok := list.([]interface{})
+			if !ok {
+				return fmt.Errorf("filter.%s must be a list", key)
+			}
+			keep[key] = make(map[string]bool)
+			for _, item := range items {
+				keep[key][fmt.Sprint(item)] = true
+			}
+		}
+		filterContext(ctx, keep)
+		ctx.filter = keep
+	}
+
+	return nil
+}
+
+// filterContext removes all stacks, services, containers and hosts that are
+// not part of the corresponding keep set. Collections without a keep set are
+// left untouched.
+func filterContext(ctx *TemplateContext, keep map[string]map[string]bool) {
+	keepStack := func(s *Stack) bool {
+		set, ok := keep["stacks"]
+		return !ok || set[s.Name]
+	}
+	keepService := func(s *Service) bool {
+		set, ok := keep["services"]
+		return (!ok || set[serviceId(s)]) && (s.Stack == nil || keepStack(s.Stack))
+	}
+	keepHost := func(h *Host) bool {
+		set, ok := keep["hosts"]
+		return !ok || set[h.UUID]
+	}
+	keepContainer := func(c *Container) bool {
+		set, ok := keep["containers"]
+		return (!ok || set[c.UUID]) &&
+			(c.Service == nil || keepService(c.Service)) &&
+			(c.Host == nil || keepHost(c.Host))
+	}
+
+	filterServices := func(in []*Service) []*Service {
+		out := make([]*Service, 0, len(in))
+		for _, s := range in {
+			if keepService(s) {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	filterContainers := func(in []*Container) []*Container {
+		out := make([]*Container, 0, len(in))
+		for _, c := range in {
+			if keepContainer(c) {
+				out = append(out, c)
+			}
+		}
+		return out
+	}
+
+	stacks := make([]*Stack, 0, len(ctx.Stacks))
+	for _, s := range ctx.Stacks {
+		if keepStack(s) {
+			s.Services = filterServices(s.Services)
+			stacks = append(stacks, s)
+		}
+	}
+	ctx.Stacks = stacks
+
+	hosts := make([]*Host, 0, len(ctx.Hosts))
+	for _, h := range ctx.Hosts {
+		if keepHost(h) {
+			h.Containers = filterContainers(h.Containers)
+			hosts = append(hosts, h)
+		}
+	}
+	ctx.Hosts = hosts
+
+	ctx.Services = filterServices(ctx.Services)
+	for _, s := range ctx.Services {
+		s.Sidekicks = filterServices(s.Sidekicks)
+		s.Containers = filterContainers(s.Containers)
+	}
+
+	ctx.Containers = filterContainers(ctx.Containers)
+	for _, c := range ctx.Containers {
+		c.Sidekicks = filterContainers(c.Sidekicks)
+	}
+}
+
+// toGeneric converts v to the generic representation produced by decoding
+// its JSON encoding.
+func toGeneric(v interface{}) (interface{}, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var out interface{}
+	if err := json.Unmarshal(buf, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func toStarlark(v interface{}) (starlark.Value, error) {
+	switch typed := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(typed), nil
+	case string:
+		return starlark.String(typed), nil
+	case float64:
+		if typed == math.Trunc(typed) && math.Abs(typed) < 1<<53 {
+			return starlark.MakeInt64(int64(typed)), nil
+		}
+		return starlark.Float(typed), nil
+	case []interface{}:
+		elems := make([]starlark.Value, 0, len(typed))
+		for _, item := range typed {
+			elem, err := toStarlark(item)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, elem)
+		}
+		return starlark.NewList(elems), nil
+	case map[string]interface{}:
+		dict := starlark.NewDict(len(typed))
+		for k, item := range typed {
+			val, err := toStarlark(item)
+			if err != nil {
+				return nil, err
+			}
+			if err := dict.SetKey(starlark.String(k), val); err != nil {
+				return nil, err
+			}
+		}
+		return dict, nil
+	default:
+		return nil, fmt.Errorf("cannot convert %T to a starlark value", v)
+	}
+}
+
+func fromStarlark(v starlark.Value) (interface{}, error) {
+	switch typed := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(typed), nil
+	case starlark.String:
+		return string(typed), nil
+	case starlark.Int:
+		if i, ok := typed.Int64(); ok {
+			return i, nil
+		}
+		return nil, fmt.Errorf("integer %s out of range", typed)
+	case starlark.Float:
+		return float64(typed), nil
+	case *starlark.List:
+		return fromStarlarkIterable(typed, typed.Len())
+	case starlark.Tuple:
+		return fromStarlarkIterable(typed, typed.Len())
+	case *starlark.Dict:
+		out := make(map[string]interface{}, typed.Len())
+		for _, item := range typed.Items() {
+			key, ok := starlark.AsString(item[0])
+			if !ok {
+				return nil, fmt.Errorf("dict keys must be strings, got %s", item[0].Type())
+			}
+			val, err := fromStarlark(item[1])
+			if err != nil {
+				return nil, err
+			}
+			out[key] = val
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("cannot convert starlark %s to a template value", v.Type())
+	}
+}
+
+func fromStarlarkIterable(v starlark.Iterable, size int) ([]interface{}, error) {
+	out := make([]interface{}, 0, size)
+	iter := v.Iterate()
+	defer iter.Done()
+
+	var item starlark.Value
+	for iter.Next(&item) {
+		val, err := fromStarlark(item)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, val)
+	}
+	return out, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// contextV1 is the context of templates written before context
+	// versions were introduced. It is used if context-version is not set.
+	contextV1 = 1
+	// contextV2 adds Bind and the numbers Public and Internal to ports,
+	// Service.Linked and Container.Healthy and fixes whereLabelMatches.
+	contextV2 = 2
+)
+
+func checkContextVersion(version int) error {
+	if version != 0 && version != contextV1 && version != contextV2 {
+		return fmt.Errorf("Unsupported context version %d", version)
+	}
+	return nil
+}
+
+// contextVersion returns the context version of the template, which
+// defaults to the global context-version.
+func (r *runner) contextVersion(t Template) int {
+	if t.CtxVersion != 0 {
+		return t.CtxVersion
+	}
+	if r.Config.ContextVersion != 0 {
+		return r.Config.ContextVersion
+	}
+	return contextV1
+}
+
+// contextForVersion returns the context for the given context version.
+// Contexts for other versions than the one of ctx are built from the same
+// metadata, get the derived values and filters of the context script and
+// are kept with ctx, so they are built at most once per cycle.
+func (r *runner) contextForVersion(ctx *TemplateContext, version int) *TemplateContext {
+	if ctx.version == version || ctx.snapshot == nil {
+		return ctx
+	}
+	if versioned, ok := ctx.versions[version]; ok {
+		return versioned
+	}
+
+	versioned, _ := r.buildContext(ctx.snapshot, version)
+	versioned.Derived = ctx.Derived
+	if ctx.filter != nil {
+		filterContext(versioned, ctx.filter)
+		versioned.filter = ctx.filter
+	}
+	if ctx.Environments != nil {
+		versioned.Environments = make(map[string]*Environment, len(ctx.Environments))
+		for name, env := range ctx.Environments {
+			envCtx, _ := r.buildContext(env.snapshot, version)
+			versioned.Environments[name] = newEnvironment(name, envCtx, env.MetadataVersion)
+		}
+	}
+
+	if ctx.versions == nil {
+		ctx.versions = make(map[int]*TemplateContext)
+	}
+	ctx.versions[version] = versioned
+	return versioned
+}
+
+// deprecations records the deprecation warnings that have been logged, so
+// each of them is only logged once.
+var deprecations = struct {
+	sync.Mutex
+	logged map[string]bool
+}{logged: make(map[string]bool)}
+
+// warnDeprecated logs a deprecation warning unless it has been logged
+// before.
+func warnDeprecated(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+
+	deprecations.Lock()
+	defer deprecations.Unlock()
+	if !deprecations.logged[msg] {
+		deprecations.logged[msg] = true
+		log.Warn(msg)
+	}
+}
+
+// addedField returns an error if a field that has been added in context
+// version 2 is used in an earlier version.
+func addedField(version int, name string) error {
+	if version < contextV2 {
+		return fmt.Errorf("Field .%s requires context-version = %d", name, contextV2)
+	}
+	return nil
+}
+
+// Bind returns the address the port is bound to, like BindAddress.
+func (p ServicePort) Bind() (string, error) {
+	return p.BindAddress, addedField(p.version, "Bind")
+}
+
+// Public returns the number of the public port, or 0 if it is not a
+// number.
+func (p ServicePort) Public() (int, error) {
+	return portNumber(p.PublicPort), addedField(p.version, "Public")
+}
+
+// Internal returns the number of the internal port, or 0 if it is not a
+// number.
+func (p ServicePort) Internal() (int, error) {
+	return portNumber(p.InternalPort), addedField(p.version, "Internal")
+}
+
+// MarshalJSON encodes the port with the fields of all context versions, so
+// the exported context doesn't depend on the version.
+func (p ServicePort) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		BindAddress  string
+		PublicPort   string
+		InternalPort string
+		Protocol     string
+		Bind         string
+		Public       int
+		Internal     int
+	}{p.BindAddress, p.PublicPort, p.InternalPort, p.Protocol, p.BindAddress, portNumber(p.PublicPort), portNumber(p.InternalPort)})
+}
+
+// Linked returns the linked services by alias.
+func (s Service) Linked() (map[string]*Service, error) {
+	return s.linked, addedField(s.version, "Linked")
+}
+
+// Healthy returns true if the container is running and healthy or has no
+// health check, like the healthy function.
+func (c Container) Healthy() (bool, error) {
+	return isHealthy(&c), addedField(c.version, "Healthy")
+}
+
+// versionFuncs replaces the functions whose behavior depends on the
+// context version of the template.
+func (r *runner) versionFuncs(t Template, funcs map[string]interface{}) {
+	if r.contextVersion(t) >= contextV2 {
+		funcs["whereLabelMatches"] = whereLabelMatches
+		return
+	}
+	funcs["whereLabelMatches"] = func(label, pattern string, in interface{}) ([]interface{}, error) {
+		warnDeprecated("whereLabelMatches compares label values for equality in context version %d. "+
+			"Set context-version = %d to match regular expressions", contextV1, contextV2)
+		return whereLabelEquals(label, pattern, in)
+	}
+}
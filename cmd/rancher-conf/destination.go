@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// remoteDestination stores rendered content somewhere else than in a local
+// file, e.g. in a Kubernetes ConfigMap. Remote destinations are configured
+// as URL in the dest option of a template.
+type remoteDestination interface {
+	// Name returns a short name for the stored content, used for the
+	// staging file passed to the check command.
+	Name() string
+	// Same returns true if the stored content equals the given content.
+	Same(content []byte) (bool, error)
+	// Write stores the content.
+	Write(content []byte) error
+}
+
+// remoteDestinations maps URL schemes to constructors of remote
+// destinations.
+var remoteDestinations = map[string]func(u *url.URL) (remoteDestination, error){
+	"configmap": newKubernetesDestination,
+	"secret":    newKubernetesDestination,
+	"consul":    newConsulDestination,
+	"s3":        newS3Destination,
+	"gcs":       newGCSDestination,
+	"etcd":      newEtcdDestination,
+}
+
+// isRemoteDestination returns true if dest is the URL of a remote
+// destination.
+func isRemoteDestination(dest string) bool {
+	i := strings.Index(dest, "://")
+	if i < 0 {
+		return false
+	}
+	_, ok := remoteDestinations[dest[:i]]
+	return ok
+}
+
+// newRemoteDestination returns the remote destination for the given URL.
+func newRemoteDestination(dest string) (remoteDestination, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid destination %s: %v", dest, err)
+	}
+
+	newDest, ok := remoteDestinations[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported destination type '%s'", u.Scheme)
+	}
+
+	d, err := newDest(u)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid destination %s: %v", dest, err)
+	}
+	return d, nil
+}
+
+// stagedWrite is a changed destination whose new content has been written
+// to a staging file.
+type stagedWrite struct {
+	dest        Destination
+	stagingFile string
+	// old is the previous content of file destinations, only read if the
+	// audit log is enabled
+	old []byte
+	// remote is set for remote destinations, whose staging file is only
+	// used by the check command
+	remote remoteDestination
+	// mountWrites is the bind-mount-writes setting
+	mountWrites string
+	// backup is a copy of the previous content of a local destination next
+	// to it, created by prepare and used by rollback. It is empty if the
+	// destination didn't exist.
+	backup string
+}
+
+const (
+	// mountWritesInPlace overwrites destinations that are mount points in
+	// place, so readers may see partially written files.
+	mountWritesInPlace = "in-place"
+	// mountWritesFail refuses to write destinations that are mount points,
+	// so all destinations are replaced atomically. It is the default.
+	mountWritesFail = "fail"
+)
+
+func checkMountWrites(mode string) error {
+	if mode != "" && mode != mountWritesInPlace && mode != mountWritesFail {
+		return fmt.Errorf("Invalid bind-mount-writes '%s'", mode)
+	}
+	return nil
+}
+
+// prepare moves the staging file of a local destination into the
+// directory of the destination, so commit can replace the destination with
+// a rename on the same filesystem. Staging files in a staging-dir on
+// another filesystem are copied. The previous content of the destination
+// is copied next to it, so rollback can restore it. All destinations of a
+// cycle are prepared before the first one is committed, so a full disk
+// can't leave some of them updated and others not.
+func (w *stagedWrite) prepare() error {
+	if w.remote != nil {
+		return nil
+	}
+
+	if filepath.Dir(w.stagingFile) != filepath.Dir(w.dest.Path) {
+		file, err := w.tempFile()
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(w.stagingFile, file)
+		if err != nil && isCrossDeviceError(err) {
+			log.Debugf("Copying staging file %s to %s", w.stagingFile, file)
+			err = copyFile(w.stagingFile, file)
+		}
+		if err != nil {
+			removeTemp(file)
+			return err
+		}
+
+		removeTemp(w.stagingFile)
+		w.stagingFile = file
+	}
+
+	if _, err := os.Stat(w.dest.Path); os.IsNotExist(err) {
+		return nil
+	}
+	backup, err := w.tempFile()
+	if err != nil {
+		return err
+	}
+	if err := copyFile(w.dest.Path, backup); err != nil {
+		removeTemp(backup)
+		return fmt.Errorf("Could not back up %s: %v", w.dest.Path, err)
+	}
+	w.backup = backup
+	return nil
+}
+
+// tempFile creates a hidden temporary file in the directory of the
+// destination.
+func (w *stagedWrite) tempFile() (string, error) {
+	fp, err := ioutil.TempFile(filepath.Dir(w.dest.Path), "."+filepath.Base(w.dest.Path)+"-")
+	if err != nil {
+		return "", err
+	}
+	trackTemp(fp.Name())
+	fp.Close()
+	return fp.Name(), nil
+}
+
+// commit writes the staged content to the destination.
+func (w *stagedWrite) commit(content []byte) error {
+	if w.remote != nil {
+		return w.remote.Write(content)
+	}
+	promoteLock.Lock()
+	defer promoteLock.Unlock()
+	return copyStagingToDestination(w.stagingFile, w.dest.Path, w.mountWrites)
+}
+
+// rollback restores the content a committed local destination had before
+// it was prepared, or removes the destination if it didn't exist. The
+// previous content of remote destinations is not known, so they can't be
+// restored.
+func (w *stagedWrite) rollback() error {
+	if w.remote != nil {
+		return fmt.Errorf("Remote destinations can't be restored")
+	}
+	promoteLock.Lock()
+	defer promoteLock.Unlock()
+	if w.backup == "" {
+		return os.Remove(w.dest.Path)
+	}
+	return copyStagingToDestination(w.backup, w.dest.Path, w.mountWrites)
+}
+
+// cleanup removes the staging file and the backup of the destination.
+func (w *stagedWrite) cleanup() {
+	removeTemp(w.stagingFile)
+	if w.backup != "" {
+		removeTemp(w.backup)
+	}
+}
+
+// copyFile copies the content, mode, owner and extended attributes of a
+// file to an existing file and syncs it to disk.
+func copyFile(src, dst string) error {
+	sfi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := writeSynced(dst, content); err != nil {
+		return err
+	}
+	if err := os.Chmod(dst, sfi.Mode()); err != nil {
+		return err
+	}
+	if err := copyOwnership(dst, sfi); err != nil {
+		return err
+	}
+	return copyXattrs(src, dst)
+}
+
+// writeSynced overwrites an existing file with content and syncs it to
+// disk. The file is truncated after it has been written, so readers never
+// see it empty, only partially updated.
+func writeSynced(path string, content []byte) error {
+	fp, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	if _, err := fp.Write(content); err != nil {
+		return err
+	}
+	if err := fp.Truncate(int64(len(content))); err != nil {
+		return err
+	}
+	return fp.Sync()
+}
+
+// stageDestination compares the content of the destination with the
+// rendered content and stages the content if it changed. It returns nil if
+// the destination is up to date.
+func (r *runner) stageDestination(t Template, d Destination, content []byte) (*stagedWrite, error) {
+	if isRemoteDestination(d.Path) {
+		return r.stageRemote(d, content)
+	}
+
+	log.Debugf("Checking whether content of %s has changed", d.Path)
+	same, err := sameContent(content, d.Path)
+	if err != nil {
+		return nil, stageErr(stageWrite, fmt.Errorf("Could not compare content for %s: %v", d.Path, err))
+	}
+	if same {
+		log.Debugf("Destination %s is up to date", d.Path)
+		return nil, nil
+	}
+
+	if err := r.checkFreeSpace(d.Path, len(content)); err != nil {
+		return nil, stageErr(stageWrite, err)
+	}
+
+	log.Debug("Creating staging file")
+	stagingFile, err := createStagingFile(content, d.Path, r.Config.StagingDir)
+	if err != nil {
+		return nil, stageErr(stageWrite, err)
+	}
+
+	if err := setDestinationAttributes(stagingFile, d, t.SELinuxLabel); err != nil {
+		removeTemp(stagingFile)
+		return nil, stageErr(stageWrite, err)
+	}
+
+	w := &stagedWrite{dest: d, stagingFile: stagingFile, mountWrites: r.Config.BindMountWrites}
+	if r.Audit != nil {
+		w.old, _ = ioutil.ReadFile(d.Path)
+	}
+
+	return w, nil
+}
+
+// stageRemote stages the content of a remote destination. The staging file
+// is created in the staging directory or the system's temporary directory.
+func (r *runner) stageRemote(d Destination, content []byte) (*stagedWrite, error) {
+	remote, err := newRemoteDestination(d.Path)
+	if err != nil {
+		return nil, stageErr(stageWrite, err)
+	}
+
+	log.Debugf("Checking whether content of %s has changed", d.Path)
+	same, err := remote.Same(content)
+	if err != nil {
+		return nil, stageErr(stageWrite, fmt.Errorf("Could not compare content for %s: %v", d.Path, err))
+	}
+	if same {
+		log.Debugf("Destination %s is up to date", d.Path)
+		return nil, nil
+	}
+
+	stagingDir := r.Config.StagingDir
+	if stagingDir == "" {
+		stagingDir = os.TempDir()
+	}
+
+	stagingFile, err := createStagingFile(content, filepath.Join(stagingDir, remote.Name()), "")
+	if err != nil {
+		return nil, stageErr(stageWrite, err)
+	}
+
+	return &stagedWrite{dest: d, stagingFile: stagingFile, remote: remote}, nil
+}
+
+// setDestinationAttributes applies the mode, owner and SELinux label
+// configured for a destination to its staging file.
+func setDestinationAttributes(stagingFile string, d Destination, label string) error {
+	if d.Mode != "" {
+		mode, err := strconv.ParseUint(d.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid mode '%s' for %s", d.Mode, d.Path)
+		}
+		if err := os.Chmod(stagingFile, os.FileMode(mode)); err != nil {
+			return fmt.Errorf("Could not set mode of %s: %v", stagingFile, err)
+		}
+	}
+
+	if d.Owner != "" || d.Group != "" {
+		if err := setOwnership(stagingFile, d.Owner, d.Group); err != nil {
+			return fmt.Errorf("Could not set owner of %s to %s:%s: %v", stagingFile, d.Owner, d.Group, err)
+		}
+	}
+
+	if label != "" {
+		if err := setSELinuxLabel(stagingFile, label); err != nil {
+			return fmt.Errorf("Could not set SELinux label of %s: %v", stagingFile, err)
+		}
+	}
+
+	return nil
+}
+
+// remoteClient is the HTTP client used by remote destinations.
+var remoteClient = &http.Client{Timeout: 30 * time.Second}
+
+// remoteRequest sends a request to a remote destination and returns the
+// body of the response.
+func remoteRequest(method, u string, header http.Header, body []byte) ([]byte, int, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	return buf, resp.StatusCode, err
+}
+
+// splitDestinationPath splits the host and path of a destination URL into
+// exactly n non-empty segments.
+func splitDestinationPath(u *url.URL, n int) ([]string, error) {
+	p := path.Join(u.Host, u.Path)
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	if len(parts) != n {
+		return nil, fmt.Errorf("expected %d path segments, got '%s'", n, p)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return nil, fmt.Errorf("empty path segment in '%s'", p)
+		}
+	}
+	return parts, nil
+}
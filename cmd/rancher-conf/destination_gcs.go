@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	gcsApiUrl      = "https://storage.googleapis.com"
+	gcsTokenUrl    = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	gcsTokenEnvVar = "GOOGLE_OAUTH_ACCESS_TOKEN"
+)
+
+// gcsDestination writes content to an object in a Google Cloud Storage
+// bucket. Destinations have the form gcs://<bucket>/<object>.
+//
+// The access token is read from GOOGLE_OAUTH_ACCESS_TOKEN or requested from
+// the metadata server of the GCE instance. Changes are detected by
+// comparing the MD5 checksum of the object with the checksum of the
+// content.
+type gcsDestination struct {
+	bucket string
+	object string
+}
+
+func newGCSDestination(u *url.URL) (remoteDestination, error) {
+	d := &gcsDestination{bucket: u.Host, object: strings.TrimPrefix(u.Path, "/")}
+	if d.bucket == "" || d.object == "" {
+		return nil, fmt.Errorf("expected gcs://<bucket>/<object>")
+	}
+	return d, nil
+}
+
+func (d *gcsDestination) Name() string {
+	return path.Base(d.object)
+}
+
+// accessToken returns the OAuth2 token used to access the API.
+func (d *gcsDestination) accessToken() (string, error) {
+	if token := os.Getenv(gcsTokenEnvVar); token != "" {
+		return token, nil
+	}
+
+	header := http.Header{}
+	header.Set("Metadata-Flavor", "Google")
+	buf, code, err := remoteRequest("GET", gcsTokenUrl, header, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not get access token from metadata server: %v", err)
+	}
+	if code != http.StatusOK {
+		return "", fmt.Errorf("could not get access token from metadata server: %s", http.StatusText(code))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(buf, &token); err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+func (d *gcsDestination) do(method, u string, body []byte) ([]byte, int, error) {
+	token, err := d.accessToken()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		header.Set("Content-Type", "application/octet-stream")
+	}
+	return remoteRequest(method, u, header, body)
+}
+
+func (d *gcsDestination) Same(content []byte) (bool, error) {
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s", gcsApiUrl, url.PathEscape(d.bucket), url.PathEscape(d.object))
+	buf, code, err := d.do("GET", u, nil)
+	if err != nil {
+		return false, err
+	}
+	if code == http.StatusNotFound {
+		return false, nil
+	}
+	if code != http.StatusOK {
+		return false, fmt.Errorf("gcs: %s: %s", http.StatusText(code), gcsError(buf))
+	}
+
+	var obj struct {
+		MD5Hash string `json:"md5Hash"`
+	}
+	if err := json.Unmarshal(buf, &obj); err != nil {
+		return false, err
+	}
+
+	sum := md5.Sum(content)
+	return obj.MD5Hash == base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+func (d *gcsDestination) Write(content []byte) error {
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+		gcsApiUrl, url.PathEscape(d.bucket), url.QueryEscape(d.object))
+	if content == nil {
+		content = []byte{}
+	}
+	buf, code, err := d.do("POST", u, content)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("gcs: %s: %s", http.StatusText(code), gcsError(buf))
+	}
+
+	return nil
+}
+
+// gcsError returns the message of a failed API response.
+func gcsError(body []byte) string {
+	var resp struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err == nil && resp.Error.Message != "" {
+		return resp.Error.Message
+	}
+	return strings.TrimSpace(string(body))
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubernetesFieldManager      = "rancher-conf"
+)
+
+// kubernetesDestination writes content to a key of a ConfigMap or Secret
+// using server-side apply. Destinations have the form
+// configmap://<namespace>/<name>/<key> or secret://<namespace>/<name>/<key>.
+//
+// The API server is accessed with the service account of the pod
+// rancher-conf runs in, which needs permission to get and patch the object.
+type kubernetesDestination struct {
+	kind      string
+	resource  string
+	namespace string
+	name      string
+	key       string
+	client    *http.Client
+	server    string
+	token     string
+}
+
+// kubernetesObject is the subset of a ConfigMap or Secret used by the
+// destination.
+type kubernetesObject struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   kubernetesMeta    `json:"metadata"`
+	Data       map[string]string `json:"data,omitempty"`
+}
+
+type kubernetesMeta struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+func newKubernetesDestination(u *url.URL) (remoteDestination, error) {
+	parts, err := splitDestinationPath(u, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &kubernetesDestination{
+		kind:      "ConfigMap",
+		resource:  "configmaps",
+		namespace: parts[0],
+		name:      parts[1],
+		key:       parts[2],
+	}
+	if u.Scheme == "secret" {
+		d.kind = "Secret"
+		d.resource = "secrets"
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster")
+	}
+	d.server = "https://" + net.JoinHostPort(host, port)
+
+	token, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("could not read service account token: %v", err)
+	}
+	d.token = strings.TrimSpace(string(token))
+
+	ca, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("could not read service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid service account CA")
+	}
+
+	d.client = &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+
+	return d, nil
+}
+
+func (d *kubernetesDestination) Name() string {
+	return d.key
+}
+
+func (d *kubernetesDestination) objectUrl() string {
+	return fmt.Sprintf("%s/api/v1/namespaces/%s/%s/%s", d.server,
+		url.PathEscape(d.namespace), d.resource, url.PathEscape(d.name))
+}
+
+// encode converts content to the representation stored in the object's
+// data. Secret data is base64 encoded.
+func (d *kubernetesDestination) encode(content []byte) string {
+	if d.kind == "Secret" {
+		return base64.StdEncoding.EncodeToString(content)
+	}
+	return string(content)
+}
+
+func (d *kubernetesDestination) do(method, u, contentType string, body []byte) ([]byte, int, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+d.token)
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	return buf, resp.StatusCode, err
+}
+
+func (d *kubernetesDestination) Same(content []byte) (bool, error) {
+	buf, code, err := d.do("GET", d.objectUrl(), "", nil)
+	if err != nil {
+		return false, err
+	}
+	if code == http.StatusNotFound {
+		return false, nil
+	}
+	if code != http.StatusOK {
+		return false, fmt.Errorf("%s %s/%s: %s", d.kind, d.namespace, d.name, kubernetesStatus(code, buf))
+	}
+
+	var obj kubernetesObject
+	if err := json.Unmarshal(buf, &obj); err != nil {
+		return false, err
+	}
+
+	current, ok := obj.Data[d.key]
+	return ok && current == d.encode(content), nil
+}
+
+// Write updates the key with server-side apply. Other keys of the object
+// are left untouched as long as they are owned by other field managers.
+func (d *kubernetesDestination) Write(content []byte) error {
+	obj := kubernetesObject{
+		APIVersion: "v1",
+		Kind:       d.kind,
+		Metadata:   kubernetesMeta{Name: d.name, Namespace: d.namespace},
+		Data:       map[string]string{d.key: d.encode(content)},
+	}
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	u := d.objectUrl() + "?fieldManager=" + kubernetesFieldManager + "&force=true"
+	buf, code, err := d.do("PATCH", u, "application/apply-patch+yaml", body)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK && code != http.StatusCreated {
+		return fmt.Errorf("%s %s/%s: %s", d.kind, d.namespace, d.name, kubernetesStatus(code, buf))
+	}
+
+	return nil
+}
+
+// kubernetesStatus returns the message of a failed API response.
+func kubernetesStatus(code int, body []byte) string {
+	var status struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &status); err == nil && status.Message != "" {
+		return status.Message
+	}
+	return http.StatusText(code)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultConsulAddr = "127.0.0.1:8500"
+	defaultEtcdAddr   = "127.0.0.1:2379"
+)
+
+// errCASConflict is returned if a key was modified between reading and
+// writing it.
+var errCASConflict = fmt.Errorf("key was modified concurrently")
+
+// kvKey returns the key of a key/value store destination URL.
+func kvKey(u *url.URL) (string, error) {
+	key := strings.Trim(u.Path, "/")
+	if key == "" {
+		return "", fmt.Errorf("missing key")
+	}
+	return key, nil
+}
+
+// consulDestination writes content to a Consul KV key. Destinations have
+// the form consul://[<host>:<port>]/<key>. The address defaults to
+// CONSUL_HTTP_ADDR and the ACL token is read from CONSUL_HTTP_TOKEN.
+//
+// Writes use check-and-set with the index read by Same, so concurrent
+// modifications are detected and reported as error.
+type consulDestination struct {
+	addr  string
+	key   string
+	token string
+	index uint64
+}
+
+func newConsulDestination(u *url.URL) (remoteDestination, error) {
+	key, err := kvKey(u)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &consulDestination{addr: u.Host, key: key, token: os.Getenv("CONSUL_HTTP_TOKEN")}
+	if d.addr == "" {
+		d.addr = os.Getenv("CONSUL_HTTP_ADDR")
+	}
+	if d.addr == "" {
+		d.addr = defaultConsulAddr
+	}
+	if !strings.Contains(d.addr, "://") {
+		d.addr = "http://" + d.addr
+	}
+
+	return d, nil
+}
+
+func (d *consulDestination) Name() string {
+	return path.Base(d.key)
+}
+
+func (d *consulDestination) keyUrl() string {
+	return d.addr + "/v1/kv/" + d.key
+}
+
+func (d *consulDestination) header() http.Header {
+	header := http.Header{}
+	if d.token != "" {
+		header.Set("X-Consul-Token", d.token)
+	}
+	return header
+}
+
+func (d *consulDestination) Same(content []byte) (bool, error) {
+	buf, code, err := remoteRequest("GET", d.keyUrl(), d.header(), nil)
+	if err != nil {
+		return false, err
+	}
+	if code == http.StatusNotFound {
+		// check-and-set with index 0 only succeeds if the key doesn't exist
+		d.index = 0
+		return false, nil
+	}
+	if code != http.StatusOK {
+		return false, fmt.Errorf("consul: %s: %s", http.StatusText(code), strings.TrimSpace(string(buf)))
+	}
+
+	var entries []struct {
+		ModifyIndex uint64
+		Value       []byte
+	}
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		return false, err
+	}
+	if len(entries) == 0 {
+		d.index = 0
+		return false, nil
+	}
+
+	d.index = entries[0].ModifyIndex
+	return bytes.Equal(entries[0].Value, content), nil
+}
+
+func (d *consulDestination) Write(content []byte) error {
+	u := fmt.Sprintf("%s?cas=%d", d.keyUrl(), d.index)
+	buf, code, err := remoteRequest("PUT", u, d.header(), content)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("consul: %s: %s", http.StatusText(code), strings.TrimSpace(string(buf)))
+	}
+	if strings.TrimSpace(string(buf)) != "true" {
+		return errCASConflict
+	}
+
+	return nil
+}
+
+// etcdDestination writes content to an etcd key using the JSON gateway of
+// the v3 API. Destinations have the form etcd://[<host>:<port>]/<key>. The
+// address defaults to the first of ETCDCTL_ENDPOINTS.
+//
+// Writes are transactions that only succeed if the revision of the key
+// didn't change since it was read by Same.
+type etcdDestination struct {
+	addr     string
+	key      string
+	revision int64
+}
+
+func newEtcdDestination(u *url.URL) (remoteDestination, error) {
+	key, err := kvKey(u)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &etcdDestination{addr: u.Host, key: key}
+	if d.addr == "" {
+		d.addr = strings.Split(os.Getenv("ETCDCTL_ENDPOINTS"), ",")[0]
+	}
+	if d.addr == "" {
+		d.addr = defaultEtcdAddr
+	}
+	if !strings.Contains(d.addr, "://") {
+		d.addr = "http://" + d.addr
+	}
+
+	return d, nil
+}
+
+func (d *etcdDestination) Name() string {
+	return path.Base(d.key)
+}
+
+func (d *etcdDestination) call(method string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	buf, code, err := remoteRequest("POST", d.addr+"/v3/"+method, header, body)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("etcd: %s: %s", http.StatusText(code), strings.TrimSpace(string(buf)))
+	}
+
+	return json.Unmarshal(buf, resp)
+}
+
+func (d *etcdDestination) Same(content []byte) (bool, error) {
+	var resp struct {
+		Kvs []struct {
+			Value       []byte `json:"value"`
+			ModRevision string `json:"mod_revision"`
+		} `json:"kvs"`
+	}
+	if err := d.call("kv/range", map[string]interface{}{"key": []byte(d.key)}, &resp); err != nil {
+		return false, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		// the revision of a missing key is 0
+		d.revision = 0
+		return false, nil
+	}
+
+	revision, err := strconv.ParseInt(resp.Kvs[0].ModRevision, 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("etcd: invalid revision '%s'", resp.Kvs[0].ModRevision)
+	}
+	d.revision = revision
+
+	return bytes.Equal(resp.Kvs[0].Value, content), nil
+}
+
+func (d *etcdDestination) Write(content []byte) error {
+	txn := map[string]interface{}{
+		"compare": []map[string]interface{}{{
+			"key":          []byte(d.key),
+			"target":       "MOD",
+			"result":       "EQUAL",
+			"mod_revision": strconv.FormatInt(d.revision, 10),
+		}},
+		"success": []map[string]interface{}{{
+			"request_put": map[string]interface{}{
+				"key":   []byte(d.key),
+				"value": content,
+			},
+		}},
+	}
+
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	if err := d.call("kv/txn", txn, &resp); err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return errCASConflict
+	}
+
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Destination writes content to an object in an S3 bucket. Destinations
+// have the form s3://<bucket>/<key>.
+//
+// Credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN, the region from AWS_REGION or AWS_DEFAULT_REGION.
+// AWS_ENDPOINT_URL selects an S3 compatible service, which is accessed with
+// path-style requests.
+//
+// Changes are detected by comparing the SHA-256 checksum of the content
+// with the one stored in the metadata of the object when it was written.
+// The ETag can't be used, as it is not the MD5 checksum of objects
+// encrypted with SSE-KMS or uploaded in parts.
+type s3Destination struct {
+	bucket    string
+	key       string
+	region    string
+	endpoint  string
+	accessKey string
+	secretKey string
+	token     string
+}
+
+func newS3Destination(u *url.URL) (remoteDestination, error) {
+	d := &s3Destination{
+		bucket:    u.Host,
+		key:       strings.TrimPrefix(u.Path, "/"),
+		region:    os.Getenv("AWS_REGION"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if d.bucket == "" || d.key == "" {
+		return nil, fmt.Errorf("expected s3://<bucket>/<key>")
+	}
+	if d.accessKey == "" || d.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	if d.region == "" {
+		d.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if d.region == "" {
+		d.region = "us-east-1"
+	}
+
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		d.endpoint = strings.TrimSuffix(endpoint, "/") + "/" + d.bucket
+	} else {
+		d.endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", d.bucket, d.region)
+	}
+
+	return d, nil
+}
+
+func (d *s3Destination) Name() string {
+	return path.Base(d.key)
+}
+
+// s3ChecksumHeader is the object metadata holding the SHA-256 checksum of
+// the content.
+const s3ChecksumHeader = "X-Amz-Meta-Rancher-Conf-Sha256"
+
+func (d *s3Destination) objectUrl() string {
+	return d.endpoint + "/" + awsURIEncode(d.key, false)
+}
+
+// awsURIEncode encodes s as required by AWS Signature Version 4: all bytes
+// but the unreserved characters A-Z, a-z, 0-9, '-', '.', '_' and '~' are
+// percent-encoded with upper case hex digits. Slashes are only encoded if
+// encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && !encodeSlash:
+			encoded.WriteByte(c)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return encoded.String()
+}
+
+// newRequest returns a signed request for the object.
+func (d *s3Destination) newRequest(method string, body []byte, header http.Header, now time.Time) (*http.Request, error) {
+	req, err := http.NewRequest(method, d.objectUrl(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	// send the path as encoded, Go would leave reserved characters like
+	// '!' or '=' unencoded
+	req.URL.RawPath = awsURIEncode(req.URL.Path, false)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	d.sign(req, body, now)
+	return req, nil
+}
+
+func (d *s3Destination) do(method string, body []byte, header http.Header) (*http.Response, []byte, error) {
+	req, err := d.newRequest(method, body, header, time.Now().UTC())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	return resp, buf, err
+}
+
+func (d *s3Destination) Same(content []byte) (bool, error) {
+	resp, _, err := d.do("HEAD", nil, nil)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("s3: %s", resp.Status)
+	}
+
+	// objects written by other tools have no checksum and are replaced
+	return resp.Header.Get(s3ChecksumHeader) == sha256Hex(content), nil
+}
+
+func (d *s3Destination) Write(content []byte) error {
+	sum := md5.Sum(content)
+	header := http.Header{}
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set(s3ChecksumHeader, sha256Hex(content))
+
+	resp, buf, err := d.do("PUT", content, header)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3: %s: %s", resp.Status, strings.TrimSpace(string(buf)))
+	}
+
+	return nil
+}
+
+// sign adds an AWS Signature Version 4 to the request.
+func (d *s3Destination) sign(req *http.Request, body []byte, now time.Time) {
+	date := now.Format("20060102")
+	timestamp := now.Format("20060102T150405Z")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", timestamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if d.token != "" {
+		req.Header.Set("X-Amz-Security-Token", d.token)
+	}
+
+	names := make([]string, 0)
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		value := strings.TrimSpace(req.Header.Get(name))
+		canonicalHeaders.WriteString(name + ":" + value + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + d.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		timestamp,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+d.secretKey), date)
+	key = hmacSHA256(key, d.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		d.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+const megabyte = 1024 * 1024
+
+// diskSpaceError is returned if a destination is not written because its
+// filesystem is nearly full.
+type diskSpaceError struct {
+	Path     string
+	Free     uint64
+	Required uint64
+}
+
+func (e *diskSpaceError) Error() string {
+	return fmt.Sprintf("Not enough free disk space for %s: %d MB free, %d MB required",
+		e.Path, e.Free/megabyte, (e.Required+megabyte-1)/megabyte)
+}
+
+// checkFreeSpace verifies that writing size bytes to the destination and
+// its staging file leaves at least min-free-disk megabytes on their
+// filesystems. A full disk would otherwise leave truncated or empty files
+// behind.
+func (r *runner) checkFreeSpace(dest string, size int) error {
+	if r.Config.MinFreeDisk <= 0 {
+		return nil
+	}
+
+	required := uint64(r.Config.MinFreeDisk)*megabyte + uint64(size)
+	dirs := []string{filepath.Dir(dest)}
+	if r.Config.StagingDir != "" {
+		dirs = append(dirs, r.Config.StagingDir)
+	}
+
+	for _, dir := range dirs {
+		free, err := freeDiskSpace(dir)
+		if err != nil {
+			return fmt.Errorf("Could not determine free disk space of %s: %v", dir, err)
+		}
+		if free < required {
+			return &diskSpaceError{Path: dir, Free: free, Required: required}
+		}
+	}
+
+	return nil
+}
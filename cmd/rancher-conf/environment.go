@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/finboxio/go-rancher-metadata/metadata"
+	log "github.com/sirupsen/logrus"
+)
+
+// RemoteEnvironment is an additional Rancher environment whose metadata is
+// read besides the one of the local metadata service, e.g. to generate
+// global DNS zones or federation proxy configs of several environments.
+type RemoteEnvironment struct {
+	Name            string `toml:"name"`
+	MetadataUrl     string `toml:"metadata-url"`
+	MetadataVersion string `toml:"metadata-version"`
+}
+
+// Environment is the metadata of an additional Rancher environment, exposed
+// to templates as .Environments.<name>. Environments have no Self.
+type Environment struct {
+	Name       string
+	Services   []*Service
+	Containers []*Container
+	Hosts      []*Host
+	Stacks     []*Stack
+	// version of the metadata API the environment has been read from
+	MetadataVersion string
+
+	// metadata the environment has been built from
+	snapshot *metadataSnapshot
+}
+
+// newEnvironment returns the environment of the given name with the
+// objects of ctx.
+func newEnvironment(name string, ctx *TemplateContext, metadataVersion string) *Environment {
+	return &Environment{
+		Name:       name,
+		Services:   ctx.Services,
+		Containers: ctx.Containers,
+		Hosts:      ctx.Hosts,
+		Stacks:     ctx.Stacks,
+
+		MetadataVersion: metadataVersion,
+		snapshot:        ctx.snapshot,
+	}
+}
+
+// environmentClient is the metadata client of an additional environment.
+type environmentClient struct {
+	name    string
+	version string
+	client  metadata.Client
+	// metadata version seen by the last call of changedEnvironments
+	lastVersion string
+	// last metadata read successfully, used while the metadata service of
+	// the environment is unavailable
+	last *metadataSnapshot
+	// set while the metadata version can't be read, so the failure is only
+	// logged once
+	unavailable bool
+}
+
+// checkEnvironments returns an error if an environment has no name or
+// metadata-url or if names are used twice.
+func checkEnvironments(envs []RemoteEnvironment) error {
+	names := make(map[string]bool)
+	for _, env := range envs {
+		if env.Name == "" {
+			return fmt.Errorf("Environment without name")
+		}
+		if env.MetadataUrl == "" {
+			return fmt.Errorf("Environment %s: metadata-url is required", env.Name)
+		}
+		if names[env.Name] {
+			return fmt.Errorf("Environment %s is configured twice", env.Name)
+		}
+		names[env.Name] = true
+	}
+	return nil
+}
+
+// newEnvironmentClients returns the clients of the additional
+// environments. Their metadata services are tried once and not waited for,
+// so an unreachable environment doesn't delay the local one; if the version
+// is "auto" and can't be negotiated, "latest" is used.
+func newEnvironmentClients(conf *Config) []*environmentClient {
+	clients := make([]*environmentClient, 0, len(conf.Environments))
+	for _, env := range conf.Environments {
+		version := env.MetadataVersion
+		if version == "" {
+			version = "latest"
+		}
+
+		log.Infof("Initializing Rancher Metadata client of environment %s (version %s)", env.Name, version)
+		client, negotiated, err := metadataClient(env.MetadataUrl, version, 0)
+		if err != nil {
+			log.Warnf("Metadata service of environment %s is unavailable: %v", env.Name, err)
+			if version == metadataVersionAuto {
+				version = "latest"
+			}
+			client, negotiated = metadata.NewClient(metadataVersionUrl(env.MetadataUrl, version)), version
+		}
+		clients = append(clients, &environmentClient{name: env.Name, version: negotiated, client: client})
+	}
+	return clients
+}
+
+// environmentContexts reads the metadata of the additional environments and
+// builds them for the given context version. Unresolved references are
+// added to report, prefixed with the name of the environment. Environments
+// whose metadata can't be read are added to report as well and keep the
+// metadata of the last successful read; they are missing until the first
+// one.
+func (r *runner) environmentContexts(report *consistencyReport, version int) map[string]*Environment {
+	envs := make(map[string]*Environment, len(r.Environments))
+	for _, env := range r.Environments {
+		meta, err := fetchMetadata(env.client, false)
+		if err != nil {
+			if env.last == nil {
+				report.add("environment %s: metadata unavailable: %v", env.name, err)
+				continue
+			}
+			report.add("environment %s: metadata unavailable, using the last metadata read: %v", env.name, err)
+			meta = env.last
+		}
+		env.last = meta
+
+		ctx, envReport := r.buildContext(meta, version)
+		for _, problem := range envReport.Problems {
+			report.add("environment %s: %s", env.name, problem)
+		}
+		envs[env.name] = newEnvironment(env.name, ctx, env.version)
+	}
+	return envs
+}
+
+// changedEnvironments returns the names of the additional environments
+// whose metadata version changed since the last call. Environments whose
+// version can't be read are checked again in the next call.
+func (r *runner) changedEnvironments() []string {
+	changed := make([]string, 0)
+	for _, env := range r.Environments {
+		version, err := env.client.GetVersion()
+		if err != nil {
+			if !env.unavailable {
+				log.Warnf("Could not read metadata version of environment %s: %v", env.name, err)
+				env.unavailable = true
+			} else {
+				log.Debugf("Could not read metadata version of environment %s: %v", env.name, err)
+			}
+			continue
+		}
+		if env.unavailable {
+			log.Infof("Metadata service of environment %s is available again", env.name)
+			env.unavailable = false
+		}
+		if version != env.lastVersion {
+			changed = append(changed, env.name)
+			env.lastVersion = version
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// eventSettle is the time (in seconds) the metadata service is given to
+	// catch up with an event.
+	eventSettle = 2
+	// maxEventBackoff limits the delay between reconnects to the event
+	// stream.
+	maxEventBackoff = time.Minute
+)
+
+// eventResourceTypes are the resource types whose changes trigger a render.
+var eventResourceTypes = []string{"container", "instance", "service", "loadBalancerService", "stack", "environment", "host"}
+
+// rancherEvent is an event of the Rancher event stream.
+type rancherEvent struct {
+	Name         string `json:"name"`
+	ResourceType string `json:"resourceType"`
+	ResourceId   string `json:"resourceId"`
+}
+
+// eventSubscriber subscribes to the event stream of the Rancher server and
+// signals changes of resources that are visible in the metadata.
+type eventSubscriber struct {
+	url       string
+	accessKey string
+	secretKey string
+	changes   chan struct{}
+}
+
+func newEventSubscriber(conf *Config) (*eventSubscriber, error) {
+	if conf.RancherUrl == "" {
+		return nil, fmt.Errorf("Events require the URL of the Rancher API (rancher-url or CATTLE_URL)")
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(conf.RancherUrl, "/") + "/subscribe")
+	if err != nil {
+		return nil, fmt.Errorf("Invalid rancher-url: %v", err)
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+	u.RawQuery = url.Values{"eventNames": {"resource.change"}}.Encode()
+
+	return &eventSubscriber{
+		url:       u.String(),
+		accessKey: conf.RancherAccessKey,
+		secretKey: conf.RancherSecretKey,
+		// a single pending change is enough to trigger the next render
+		changes: make(chan struct{}, 1),
+	}, nil
+}
+
+// run reads the event stream until the process exits, reconnecting with
+// exponential backoff.
+func (s *eventSubscriber) run() {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := s.subscribe()
+		log.Warnf("Rancher event stream closed: %v", err)
+
+		if time.Since(start) > maxEventBackoff {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxEventBackoff {
+			backoff = maxEventBackoff
+		}
+	}
+}
+
+func (s *eventSubscriber) subscribe() error {
+	header := http.Header{}
+	if s.accessKey != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(s.accessKey + ":" + s.secretKey))
+		header.Set("Authorization", "Basic "+auth)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(s.url, header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	log.Infof("Subscribed to Rancher events")
+	// changes may have been missed while the stream was down
+	s.signal()
+
+	for {
+		var event rancherEvent
+		if err := conn.ReadJSON(&event); err != nil {
+			return err
+		}
+		if event.Name != "resource.change" || !containsString(eventResourceTypes, event.ResourceType) {
+			continue
+		}
+		log.Debugf("Received %s event for %s %s", event.Name, event.ResourceType, event.ResourceId)
+		s.signal()
+	}
+}
+
+func (s *eventSubscriber) signal() {
+	select {
+	case s.changes <- struct{}{}:
+	default:
+	}
+}
+
+// waitEvent blocks until an event has been received or maxWait seconds
+// elapsed, and returns the current metadata version. After an event, the
+// metadata service is given some time to reflect the change.
+func (r *runner) waitEvent(version string, maxWait int) (string, error) {
+	select {
+	case <-r.Events.changes:
+		log.Debug("Change event received, checking metadata version")
+		return r.waitVersion(version, eventSettle)
+	case <-time.After(time.Duration(maxWait) * time.Second):
+		return r.Client.GetVersion()
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// lockPollInterval is the interval in which a held lock is retried.
+const lockPollInterval = time.Second
+
+// instanceLock is an advisory lock on a file that prevents several
+// instances from writing the same destinations. The lock is released by the
+// operating system when the process exits.
+type instanceLock struct {
+	file *os.File
+}
+
+// acquireLock locks the file at path. If the lock is held by another
+// process, it is retried until wait elapsed. A negative wait retries
+// forever.
+func acquireLock(path string, wait time.Duration) (*instanceLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open lock file %s: %v", path, err)
+	}
+
+	deadline := time.Now().Add(wait)
+	logged := false
+	for {
+		locked, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Could not lock %s: %v", path, err)
+		}
+		if locked {
+			break
+		}
+
+		holder := lockHolder(path)
+		if wait >= 0 && !time.Now().Before(deadline) {
+			file.Close()
+			return nil, fmt.Errorf("Lock file %s is held by another rancher-conf instance%s", path, holder)
+		}
+		if !logged {
+			log.Infof("Waiting for lock file %s held by another rancher-conf instance%s", path, holder)
+			logged = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	// record the pid of the holder for the error message of other instances
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+
+	log.Debugf("Acquired lock %s", path)
+	return &instanceLock{file: file}, nil
+}
+
+// lockHolder returns a description of the process holding the lock.
+func lockHolder(path string) string {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	if pid := strings.TrimSpace(string(buf)); pid != "" {
+		return fmt.Sprintf(" (pid %s)", pid)
+	}
+	return ""
+}
+
+// Release releases the lock. It is a no-op on nil locks.
+func (l *instanceLock) Release() {
+	if l == nil {
+		return
+	}
+	l.file.Close()
+}
@@ -4,6 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -13,19 +16,68 @@ var (
 	Version string = "UNDEFINED"
 	GitSHA  string = "UNDEFINED"
 
-	configFile      string
-	metadataUrl     string
-	metadataVersion string
-	logLevel        string
-	checkCmd        string
-	updateCmd       string
-	notifyCmd       string
-	onetime         bool
-	showVersion     bool
-	notifyOutput    bool
-	includeInactive bool
-	interval        int
-	selfId          string
+	configFile        string
+	metadataUrl       string
+	metadataVersion   string
+	logLevel          string
+	checkCmd          string
+	updateCmd         string
+	notifyCmd         string
+	engine            string
+	onetime           bool
+	showVersion       bool
+	notifyOutput      bool
+	includeInactive   bool
+	requireConsistent bool
+	interval          int
+	selfId            string
+	contextScript     string
+	alwaysRender      bool
+	stagingDir        string
+	changedExitCode   int
+	maxFailures       int
+	exitOnError       string
+	shell             string
+	notifyRetries     int
+	notifyBackoff     int
+	adminAddr         string
+	reloadUnitName    string
+	compress          string
+	auditLogPath      string
+	reportWebhook     string
+	sentryDSN         string
+	lockFile          string
+	lockWait          int
+	stacksFlag        string
+	servicesFlag      string
+	validateFormat    string
+	checkProfile      string
+	postProcessCmd    string
+	templateLibDir    string
+	minFreeDisk       int
+	events            bool
+	rancherUrl        string
+	startupSettle     int
+	expectedServices  string
+	onlyTemplates     string
+	skipTemplates     string
+	destPrefix        string
+	snapshotDir       string
+	secretsDir        string
+	subreaper         bool
+	metadataWaitFlag  int
+	metadataFallback  string
+	snapshotKeep      int
+	manifestPath      string
+	notifyConcurrency int
+	contextVersion    int
+	bindMountWrites   string
+	waitFor           string
+	waitForTimeout    int
+	cleanupOrphans    bool
+	cleanup           bool
+	redactPatterns    = listFlag{}
+	vars              = varsFlag{}
 )
 
 func init() {
@@ -35,18 +87,99 @@ func init() {
 	flag.StringVar(&configFile, "config", "", "Path to optional config file")
 	flag.StringVar(&metadataUrl, "metadata-url", "http://rancher-metadata", "Metadata endpoint to use for querying the Metadata API")
 	flag.StringVar(&metadataVersion, "metadata-version", "latest", "Metadata version to use for querying the Metadata API")
+	flag.IntVar(&metadataWaitFlag, "metadata-wait", defaultMetadataWait, "Time (in seconds) to wait for the metadata service on startup (-1 to wait forever, 0 to try once)")
+	flag.StringVar(&metadataFallback, "metadata-unavailable", metadataFail, "Behavior if the metadata service is unavailable after metadata-wait (fail,degraded)")
+	flag.BoolVar(&events, "events", false, "Render on changes from the Rancher event stream, in addition to polling")
+	flag.StringVar(&rancherUrl, "rancher-url", "", "URL of the Rancher API used for events. Defaults to CATTLE_URL")
 	flag.IntVar(&interval, "interval", 60, "Interval (in seconds) for updateing the Metadata API for changes")
-	flag.BoolVar(&includeInactive, "include-inactive", false, "Not yet implemented")
+	flag.BoolVar(&includeInactive, "include-inactive", false, "Include stopped and other inactive containers in the context")
+	flag.BoolVar(&requireConsistent, "require-consistent", false, "Defer rendering while references between metadata objects can't be resolved, e.g. during upgrades")
 	flag.BoolVar(&onetime, "onetime", false, "Process all templates once and exit")
+	flag.IntVar(&startupSettle, "startup-settle", 0, "Delay the first render until the metadata version did not change for this many seconds")
+	flag.StringVar(&expectedServices, "expected-services", "", "Comma separated list of services ('stack-name/service-name' or 'service-name[.stack-name]') that must be present before the first render")
+	flag.StringVar(&waitFor, "wait-for", "", "Template expression that must be true before the first render, e.g. 'ge (len (healthy (service \"galera.db\").Containers)) 3'")
+	flag.IntVar(&waitForTimeout, "wait-for-timeout", 0, "Time (in seconds) to wait for wait-for before exiting with an error (0 to wait forever)")
+	flag.StringVar(&onlyTemplates, "only", "", "Comma separated list of templates (name or source) to process, all others are disabled")
+	flag.StringVar(&skipTemplates, "skip", "", "Comma separated list of templates (name or source) to disable")
+	flag.IntVar(&changedExitCode, "changed-exit-code", 0, "Exit code used in onetime mode if any destination has been updated")
+	flag.IntVar(&maxFailures, "max-failures", 0, "Exit after this many consecutive failed cycles (0 to never exit)")
+	flag.StringVar(&exitOnError, "exit-on-error", "", "Comma separated list of failure stages that terminate the process (metadata,script,render,check,write,notify,command,any)")
 	flag.StringVar(&logLevel, "log-level", "info", "Verbosity of log output (debug,info,warn,error)")
 	flag.StringVar(&checkCmd, "check-cmd", "", "Command to check the content before updating the destination file.")
+	flag.StringVar(&postProcessCmd, "post-process-cmd", "", "Command the rendered content is piped through before it is compared and written, e.g. \"jq -S .\"")
+	flag.StringVar(&checkProfile, "check", "", "Built-in check of the destination before it is updated (nginx,haproxy,prometheus)")
 	flag.StringVar(&updateCmd, "update-cmd", "", "Command to run after each version update.")
 	flag.StringVar(&notifyCmd, "notify-cmd", "", "Command to run after the destination file has been updated.")
+	flag.IntVar(&notifyRetries, "notify-retries", 0, "Number of retries of a failed notify command")
+	flag.IntVar(&notifyBackoff, "notify-backoff", 1, "Initial delay (in seconds) between retries of the notify command, doubled after each retry")
+	flag.IntVar(&notifyConcurrency, "notify-concurrency", 1, "Number of notify commands of a cycle that run at the same time")
+	flag.StringVar(&reloadUnitName, "reload-unit", "", "Systemd unit to reload over D-Bus after the destination file has been updated")
+	flag.StringVar(&auditLogPath, "audit-log", "", "Path of a file to append a JSON record of every render and command execution to")
+	flag.StringVar(&reportWebhook, "report-webhook", "", "URL to post a JSON report of template failures to")
+	flag.StringVar(&sentryDSN, "sentry-dsn", "", "Sentry DSN to report template failures to")
+	flag.StringVar(&lockFile, "lock-file", "", "Path of a lock file that prevents several instances from running concurrently")
+	flag.IntVar(&lockWait, "lock-wait", 0, "Time (in seconds) to wait for a lock file held by another instance (-1 to wait forever)")
+	flag.StringVar(&adminAddr, "admin-addr", "", "Address to serve the status (/status) and metrics (/metrics) on, e.g. \":8080\"")
+	flag.StringVar(&shell, "shell", "", "Shell and arguments used to run commands, e.g. \"/bin/bash -c\"")
+	flag.StringVar(&stacksFlag, "stacks", "", "Comma separated list of stacks visible to the template")
+	flag.StringVar(&servicesFlag, "services", "", "Comma separated list of services ('stack-name/service-name' or 'service-name[.stack-name]') visible to the template")
+	flag.Var(&redactPatterns, "redact", "Regular expression of secrets masked in logs and error reports (can be repeated)")
+	flag.Var(vars, "var", "Variable exposed as .Vars in templates, in the form key=value (can be repeated)")
+	flag.IntVar(&contextVersion, "context-version", contextV1, "Version of the context and functions available to templates (1,2)")
+	flag.StringVar(&engine, "engine", "go", "Template engine used to render the source (go,pongo2,jsonnet)")
+	flag.StringVar(&validateFormat, "validate-format", "", "Parse the rendered content before updating the destination (json,yaml,toml,xml)")
+	flag.StringVar(&compress, "compress", "", "Compress the rendered content before writing it to the destination (gzip)")
 	flag.BoolVar(&notifyOutput, "notify-output", false, "Print the result of the notify command to STDOUT")
+	flag.BoolVar(&alwaysRender, "always-render", false, "Render templates on every metadata version, even if the context is unchanged")
+	flag.IntVar(&minFreeDisk, "min-free-disk", 0, "Free disk space (in megabytes) that must remain after writing a destination (0 to disable)")
+	flag.StringVar(&templateLibDir, "template-lib-dir", "", "Directory of templates parsed into the namespace of every go template")
+	flag.BoolVar(&subreaper, "subreaper", false, "Reap orphaned descendant processes even if not running as PID 1 (Linux only)")
+	flag.StringVar(&secretsDir, "secrets-dir", defaultSecretsDir, "Directory of the secret files read by the secretFile function")
+	flag.StringVar(&snapshotDir, "snapshot-dir", "", "Directory in which the context of each metadata version is saved for debugging")
+	flag.IntVar(&snapshotKeep, "snapshot-keep", defaultSnapshotKeep, "Number of context snapshots to keep")
+	flag.StringVar(&manifestPath, "manifest", "", "Path of a file recording the files written by rancher-conf")
+	flag.BoolVar(&cleanupOrphans, "cleanup-orphans", false, "Remove files in the manifest that are no longer produced by any template after each cycle")
+	flag.BoolVar(&cleanup, "cleanup", false, "Remove files in the manifest that are no longer produced by any template and exit")
+	flag.StringVar(&destPrefix, "dest-prefix", "", "Directory prepended to all destination paths, e.g. the mount point of the host's /etc")
+	flag.StringVar(&bindMountWrites, "bind-mount-writes", mountWritesFail, "Writes to destinations that are mount points, which can't be replaced atomically (in-place,fail)")
+	flag.StringVar(&stagingDir, "staging-dir", "", "Directory for staging files. Defaults to the directory of each destination")
 	flag.BoolVar(&showVersion, "version", false, "Show application version and exit")
 	flag.StringVar(&selfId, "self", "", "Render with context of {id} as self")
+	flag.StringVar(&contextScript, "context-script", "", "Starlark script used to transform the context before rendering")
 	flag.Usage = printUsage
-	flag.Parse()
+}
+
+// varsFlag collects the key=value pairs of repeated --var flags.
+type varsFlag map[string]string
+
+func (v varsFlag) String() string {
+	pairs := make([]string, 0)
+	for key, value := range v {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v varsFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected key=value")
+	}
+	v[parts[0]] = parts[1]
+	return nil
+}
+
+// listFlag collects the values of a repeated flag.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
 }
 
 func printUsage() {
@@ -63,16 +196,19 @@ Arguments:
 }
 
 func main() {
+	// flags are parsed here rather than in init, so tests can be run
+	flag.Parse()
 	if showVersion {
 		fmt.Printf("rancher-conf version %s (%s) \n", Version, GitSHA)
 		os.Exit(0)
 	}
 
-	if flag.NArg() < 1 && len(configFile) == 0 {
+	if flag.NArg() < 1 && len(configFile) == 0 && waitFor == "" && os.Getenv("RANCHER_GEN_WAIT_FOR") == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	log.SetFormatter(&redactingFormatter{Formatter: log.StandardLogger().Formatter})
 	log.Infof("Starting rancher-conf %s (%s)", Version, GitSHA)
 
 	conf, err := initConfig(configFile)
@@ -80,12 +216,35 @@ func main() {
 		log.Fatal(err.Error())
 	}
 
+	var lock *instanceLock
+	if conf.LockFile != "" {
+		lock, err = acquireLock(conf.LockFile, time.Duration(conf.LockWait)*time.Second)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+
+	handleSignals(lock)
+	startReaper(conf.Subreaper)
+
+	if cleanup {
+		if err := runCleanup(conf); err != nil {
+			log.Fatal(err.Error())
+		}
+		lock.Release()
+		os.Exit(0)
+	}
+
 	r, err := NewRunner(conf)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
-	if err := r.Run(); err != nil {
+	code, err := r.Run()
+	if err != nil {
 		log.Fatal(err)
 	}
+
+	lock.Release()
+	os.Exit(code)
 }
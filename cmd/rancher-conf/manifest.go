@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// manifest records the local files managed by rancher-conf, so that files
+// which are no longer produced by any template can be removed. It is
+// persisted as JSON in the file configured with manifest.
+type manifest struct {
+	path  string
+	dirty bool
+
+	Files map[string]manifestEntry `json:"files"`
+}
+
+// manifestEntry describes a managed file. The hash is the checksum of the
+// content last written or found up to date, files modified since are not
+// removed.
+type manifestEntry struct {
+	Template string    `json:"template"`
+	Hash     string    `json:"hash"`
+	Updated  time.Time `json:"updated"`
+}
+
+// loadManifest reads the manifest at path. A missing file is an empty
+// manifest. It returns nil if path is empty, all methods of manifest are
+// no-ops on nil manifests.
+func loadManifest(path string) (*manifest, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	m := &manifest{path: path, Files: make(map[string]manifestEntry)}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read manifest: %v", err)
+	}
+	if err := json.Unmarshal(buf, m); err != nil {
+		return nil, fmt.Errorf("Could not parse manifest %s: %v", path, err)
+	}
+	if m.Files == nil {
+		m.Files = make(map[string]manifestEntry)
+	}
+	return m, nil
+}
+
+// add records the local destinations of a template with their content.
+func (m *manifest) add(t Template, content []byte) {
+	if m == nil {
+		return
+	}
+
+	hash := sha256Hex(content)
+	for _, d := range t.destinations() {
+		if isRemoteDestination(d.Path) {
+			continue
+		}
+		path := filepath.Clean(d.Path)
+		if e, ok := m.Files[path]; ok && e.Hash == hash && e.Template == t.name() {
+			continue
+		}
+		m.Files[path] = manifestEntry{Template: t.name(), Hash: hash, Updated: time.Now().UTC()}
+		m.dirty = true
+	}
+}
+
+// save writes the manifest if it changed since it was loaded or saved.
+func (m *manifest) save() error {
+	if m == nil || !m.dirty {
+		return nil
+	}
+
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not encode manifest: %v", err)
+	}
+
+	tmp := m.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(buf, '\n'), 0644); err != nil {
+		return fmt.Errorf("Could not write manifest: %v", err)
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Could not write manifest: %v", err)
+	}
+	m.dirty = false
+	return nil
+}
+
+// orphans returns the recorded files that are not among the given
+// destination paths.
+func (m *manifest) orphans(owned []string) []string {
+	orphans := make([]string, 0)
+	if m == nil {
+		return orphans
+	}
+	for path := range m.Files {
+		if !containsString(owned, path) {
+			orphans = append(orphans, path)
+		}
+	}
+	sort.Strings(orphans)
+	return orphans
+}
+
+// removeOrphans removes the recorded files that are not among the given
+// destination paths and forgets them. Files whose content changed since
+// rancher-conf last wrote them are kept. It returns the removed files.
+func (m *manifest) removeOrphans(owned []string) []string {
+	removed := make([]string, 0)
+	for _, path := range m.orphans(owned) {
+		entry := m.Files[path]
+
+		// failed reads and removals are retried the next time
+		buf, err := ioutil.ReadFile(path)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			log.Warnf("Could not read orphaned file %s: %v", path, err)
+			continue
+		case sha256Hex(buf) != entry.Hash:
+			log.Warnf("Keeping orphaned file %s of template %s, it has been modified", path, entry.Template)
+		default:
+			if err := os.Remove(path); err != nil {
+				log.Warnf("Could not remove orphaned file %s: %v", path, err)
+				continue
+			}
+			log.Infof("Removed orphaned file %s of template %s", path, entry.Template)
+			removed = append(removed, path)
+		}
+
+		delete(m.Files, path)
+		m.dirty = true
+	}
+	return removed
+}
+
+// ownedPaths returns the local destination paths of the templates.
+func ownedPaths(templates []Template) []string {
+	paths := make([]string, 0)
+	for _, t := range templates {
+		for _, d := range t.destinations() {
+			if !isRemoteDestination(d.Path) {
+				paths = append(paths, filepath.Clean(d.Path))
+			}
+		}
+	}
+	return paths
+}
+
+// runCleanup removes the files in the manifest that are no longer produced
+// by any template and is used by the cleanup mode.
+func runCleanup(conf *Config) error {
+	if conf.Manifest == "" {
+		return fmt.Errorf("Cleanup requires a manifest")
+	}
+
+	m, err := loadManifest(conf.Manifest)
+	if err != nil {
+		return err
+	}
+
+	removed := m.removeOrphans(conf.OwnedPaths)
+	log.Infof("Removed %d orphaned files", len(removed))
+	return m.save()
+}
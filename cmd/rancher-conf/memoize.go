@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+// parseMemoizeKeys parses the memoize-key of all templates, so errors are
+// reported on startup. The keys are executed with the functions of the
+// context of each cycle.
+func (r *runner) parseMemoizeKeys() error {
+	for i, t := range r.Config.Templates {
+		if t.MemoizeKey == "" {
+			continue
+		}
+
+		funcs := r.funcMap(&TemplateContext{})
+		r.versionFuncs(t, funcs)
+		key, err := template.New("memoize-key").Funcs(funcs).Parse(t.MemoizeKey)
+		if err != nil {
+			return fmt.Errorf("Template %s: invalid memoize-key: %v", t.Source, err)
+		}
+		r.memoizeKeys[i] = key
+	}
+	return nil
+}
+
+// inputHash returns the checksum of the inputs of the template with the
+// given index: the version of its source and template library and the
+// output of its memoize-key if it has one, otherwise its projected context.
+// The template is only rendered again once the checksum changes.
+func (r *runner) inputHash(i int, t Template, ctx *TemplateContext) (string, error) {
+	key, ok := r.memoizeKeys[i]
+	if !ok {
+		return contextHash(ctx, r.sourceVersion(t))
+	}
+
+	buf := bytes.NewBufferString(r.sourceVersion(t))
+	funcs := r.funcMap(ctx)
+	r.versionFuncs(t, funcs)
+	if err := key.Funcs(funcs).Execute(buf, r.templateData(t, ctx)); err != nil {
+		return "", fmt.Errorf("Could not execute memoize-key: %v", err)
+	}
+	return sha256Hex(buf.Bytes()), nil
+}
+
+// memoized returns true if the template is only rendered again when its
+// inputs change.
+func (t Template) memoized() bool {
+	return t.hasProjection() || t.MemoizeKey != ""
+}
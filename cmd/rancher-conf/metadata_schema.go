@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// MetaSchema declares the metadata keys a template expects from services.
+// Keys are paths into the metadata tree separated by dots, e.g.
+// 'upstream.port'. Values are one of the types in schemaTypes, keys whose
+// type ends in '?' are optional.
+type MetaSchema struct {
+	// services whose metadata is validated, identified as
+	// 'stack-name/service-name' or 'service-name[.stack-name]'. Defaults
+	// to all services visible to the template.
+	Services []string          `toml:"services"`
+	Keys     map[string]string `toml:"keys"`
+}
+
+// schemaTypes maps the types of a schema to functions checking a value.
+var schemaTypes = map[string]func(interface{}) bool{
+	"any": func(v interface{}) bool { return true },
+	"string": func(v interface{}) bool {
+		_, ok := v.(string)
+		return ok
+	},
+	"int": func(v interface{}) bool {
+		f, ok := toNumber(v)
+		return ok && f == math.Trunc(f)
+	},
+	"number": func(v interface{}) bool {
+		_, ok := toNumber(v)
+		return ok
+	},
+	"bool": func(v interface{}) bool {
+		_, ok := v.(bool)
+		return ok
+	},
+	"list": func(v interface{}) bool {
+		_, ok := v.([]interface{})
+		return ok
+	},
+	"map": func(v interface{}) bool {
+		_, ok := v.(map[string]interface{})
+		if !ok {
+			_, ok = v.(MetadataMap)
+		}
+		return ok
+	},
+}
+
+// check returns an error if the schema declares unsupported types.
+func (s *MetaSchema) check() error {
+	if s == nil {
+		return nil
+	}
+	for key, typ := range s.Keys {
+		if _, ok := schemaTypes[strings.TrimSuffix(typ, "?")]; !ok {
+			return fmt.Errorf("Unsupported type '%s' of metadata key %s", typ, key)
+		}
+	}
+	return nil
+}
+
+// validate checks the metadata of the services of the context against the
+// schema and returns an error listing every violation.
+func (s *MetaSchema) validate(ctx *TemplateContext) error {
+	if s == nil || len(s.Keys) == 0 {
+		return nil
+	}
+
+	services := ctx.Services
+	if len(s.Services) > 0 {
+		services = make([]*Service, 0)
+		for _, ref := range s.Services {
+			name, stack := parseServiceRef(ref, ctx.Self.stackName())
+			found := false
+			for _, svc := range ctx.Services {
+				if strings.EqualFold(svc.Name, name) && svc.Stack != nil && strings.EqualFold(svc.Stack.Name, stack) {
+					services = append(services, svc)
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Errorf("Service %s of the metadata schema does not exist", ref)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(s.Keys))
+	for key := range s.Keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	problems := make([]string, 0)
+	for _, svc := range services {
+		for _, key := range keys {
+			typ := s.Keys[key]
+			optional := strings.HasSuffix(typ, "?")
+			typ = strings.TrimSuffix(typ, "?")
+
+			value, ok := svc.Metadata.lookup(key)
+			if !ok {
+				if !optional {
+					problems = append(problems, fmt.Sprintf("service %s: missing metadata key %s", serviceRef(svc), key))
+				}
+				continue
+			}
+			if !schemaTypes[typ](value) {
+				problems = append(problems, fmt.Sprintf("service %s: metadata key %s must be %s, got %s", serviceRef(svc), key, typ, schemaTypeOf(value)))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Metadata does not match the schema: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// serviceRef returns the 'stack-name/service-name' reference of a service.
+func serviceRef(s *Service) string {
+	if s.Stack == nil {
+		return s.Name
+	}
+	return s.Stack.Name + "/" + s.Name
+}
+
+// schemaTypeOf returns the name of the schema type of a value.
+func schemaTypeOf(v interface{}) string {
+	for _, typ := range []string{"bool", "int", "number", "string", "list", "map"} {
+		if schemaTypes[typ](v) {
+			return typ
+		}
+	}
+	if v == nil {
+		return "null"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/finboxio/go-rancher-metadata/metadata"
+	log "github.com/sirupsen/logrus"
+)
+
+// metadataVersionAuto selects the newest metadata API version supported by
+// the metadata service.
+const metadataVersionAuto = "auto"
+
+// knownMetadataVersions are the versions of the metadata API, newest first.
+var knownMetadataVersions = []string{"2016-07-29", "2015-12-19", "2015-07-25"}
+
+// metadataClient returns a client for the metadata API at base, waiting up
+// to maxWait until the service is reachable, see waitForMetadata. With
+// version "auto" the known versions are probed and the newest one served is
+// used, falling back to "latest". The negotiated version is returned with
+// the client.
+func metadataClient(base, version string, maxWait time.Duration) (metadata.Client, string, error) {
+	versionUrl := func(v string) string {
+		return metadataVersionUrl(base, v)
+	}
+
+	if version != metadataVersionAuto {
+		client := metadata.NewClient(versionUrl(version))
+		if err := waitForMetadata(client, maxWait); err != nil {
+			return nil, "", err
+		}
+		return client, version, nil
+	}
+
+	latest := metadata.NewClient(versionUrl("latest"))
+	if err := waitForMetadata(latest, maxWait); err != nil {
+		return nil, "", err
+	}
+
+	for _, v := range knownMetadataVersions {
+		client := metadata.NewClient(versionUrl(v))
+		if _, err := client.GetVersion(); err != nil {
+			log.Debugf("Metadata version %s is not supported: %v", v, err)
+			continue
+		}
+		log.Infof("Negotiated metadata version %s", v)
+		return client, v, nil
+	}
+
+	log.Warnf("None of the known metadata versions is supported. Falling back to latest")
+	return latest, "latest", nil
+}
+
+// metadataVersionUrl returns the URL of the given version of the metadata
+// API at base.
+func metadataVersionUrl(base, version string) string {
+	u, _ := url.Parse(base)
+	u.Path = path.Join(u.Path, version)
+	return u.String()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+	"github.com/finboxio/go-rancher-metadata/metadata"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// metadataFail exits if the metadata service is unavailable on startup.
+	metadataFail = "fail"
+	// metadataDegraded starts without metadata and keeps connecting in the
+	// background.
+	metadataDegraded = "degraded"
+	// defaultMetadataWait is the time in seconds to wait for the metadata
+	// service on startup if metadata-wait is not set, after which
+	// metadata-unavailable applies.
+	defaultMetadataWait = 60
+	// maxMetadataBackoff limits the delay between connection attempts.
+	maxMetadataBackoff = 30 * time.Second
+)
+
+// checkMetadataUnavailable returns an error if mode is not supported.
+func checkMetadataUnavailable(mode string) error {
+	switch mode {
+	case "", metadataFail, metadataDegraded:
+		return nil
+	}
+	return fmt.Errorf("Unsupported metadata-unavailable mode '%s'", mode)
+}
+
+// metadataWait returns the time to wait for the metadata service on
+// startup. Negative values wait forever, zero tries once.
+func metadataWait(conf *Config) time.Duration {
+	return time.Duration(conf.MetadataWait) * time.Second
+}
+
+// waitForMetadata tries to reach the metadata service with exponential
+// backoff until it answers or maxWait elapsed. With a negative maxWait it
+// waits forever, with zero it tries once.
+func waitForMetadata(client metadata.Client, maxWait time.Duration) error {
+	deadline := time.Now().Add(maxWait)
+	backoff := time.Second
+	for {
+		_, err := client.GetVersion()
+		if err == nil {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if maxWait >= 0 && remaining <= 0 {
+			return err
+		}
+		log.Debugf("Metadata service is unavailable: %v. Retrying in %s", err, backoff)
+
+		wait := backoff
+		if maxWait >= 0 && remaining < wait {
+			wait = remaining
+		}
+		time.Sleep(wait)
+		if backoff *= 2; backoff > maxMetadataBackoff {
+			backoff = maxMetadataBackoff
+		}
+	}
+}
+
+// connectMetadata creates the metadata client of a runner that started
+// degraded. It retries with backoff until the metadata service is
+// reachable, pinging the systemd watchdog meanwhile.
+func (r *runner) connectMetadata() {
+	watchdog := sdWatchdogInterval() > 0
+	sdNotify("STATUS=Waiting for the metadata service")
+
+	backoff := time.Second
+	for {
+		client, version, err := metadataClient(r.Config.MetadataUrl, r.Config.MetadataVersion, 0)
+		if err == nil {
+			log.Infof("Connected to the metadata service")
+			r.Client = client
+			r.Config.MetadataVersion = version
+			return
+		}
+
+		log.Warnf("Metadata service is unavailable: %v. Retrying in %s", err, backoff)
+		if watchdog {
+			sdNotify(daemon.SdNotifyWatchdog)
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxMetadataBackoff {
+			backoff = maxMetadataBackoff
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// notifyJob is the notify command of a template, which runs once all
+// destinations of the cycle have been written.
+type notifyJob struct {
+	index  int
+	tmpl   Template
+	status *templateStatus
+	record *auditRecord
+
+	finished bool
+	err      error
+}
+
+func newNotifyJob(index int, t Template, status *templateStatus, record *auditRecord) *notifyJob {
+	return &notifyJob{index: index, tmpl: t, status: status, record: record}
+}
+
+// hasNotify returns true if the template runs a notify command or reloads
+// a unit after its destinations have been updated.
+func (t Template) hasNotify() bool {
+	return !t.NotifyCmd.IsEmpty() || t.ReloadUnit != ""
+}
+
+// runNotifyJobs runs the notify commands of a cycle in the order of the
+// templates, at most notify-concurrency at a time. A command only starts
+// once the commands of the templates listed in its notify-after have
+// finished. If one of them failed, the command is not run and marked as
+// pending, so it is retried in the next cycle in the same order. The
+// errors are set on the jobs.
+func (r *runner) runNotifyJobs(jobs []*notifyJob) {
+	limit := r.Config.NotifyConcurrency
+	if limit < 1 {
+		limit = 1
+	}
+
+	results := make(chan *notifyJob)
+	pending := append([]*notifyJob{}, jobs...)
+	running := 0
+	for len(pending) > 0 || running > 0 {
+		before := len(pending)
+		waiting := make([]*notifyJob, 0, len(pending))
+		for _, job := range pending {
+			ready := true
+			for _, dep := range jobs {
+				if dep == job || !dep.tmpl.matchesName(job.tmpl.NotifyAfter) {
+					continue
+				}
+				if dep.finished && dep.err != nil && !job.finished {
+					job.err = fmt.Errorf("not run, the notify command of %s failed", dep.tmpl.name())
+					job.finished = true
+					r.Status.update(func() {
+						job.status.NotifyPending = true
+					})
+				}
+				ready = ready && dep.finished
+			}
+
+			switch {
+			case job.finished:
+			case ready && running < limit:
+				running++
+				go func(job *notifyJob) {
+					job.err = r.runNotify(job.tmpl, job.status, job.record)
+					results <- job
+				}(job)
+			default:
+				waiting = append(waiting, job)
+			}
+		}
+		pending = waiting
+
+		if running == 0 {
+			if len(pending) == before {
+				// can't happen, cycles are rejected by checkNotifyOrder
+				log.Errorf("Notify commands wait for each other: %d not run", len(pending))
+				return
+			}
+			// the remaining jobs wait for jobs that failed in this pass
+			continue
+		}
+		job := <-results
+		job.finished = true
+		running--
+	}
+}
+
+// checkNotifyOrder returns an error if notify-after refers to unknown
+// templates or the order contains a cycle.
+func checkNotifyOrder(templates []Template) error {
+	for _, t := range templates {
+		for _, name := range t.NotifyAfter {
+			if findTemplate(templates, name) < 0 {
+				return fmt.Errorf("Template %s: unknown template '%s' in notify-after", t.Source, name)
+			}
+		}
+	}
+
+	// depth first search for a template that is reached again on its own
+	// path
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(templates))
+	path := make([]string, 0)
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visiting:
+			return fmt.Errorf("Cycle in notify-after: %s", strings.Join(append(path, templates[i].name()), " -> "))
+		case visited:
+			return nil
+		}
+
+		state[i] = visiting
+		path = append(path, templates[i].name())
+		for j, other := range templates {
+			if other.matchesName(templates[i].NotifyAfter) {
+				if err := visit(j); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		return nil
+	}
+
+	for i := range templates {
+		if err := visit(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyFailed logs and reports a failed notify job of a cycle and records
+// the error.
+func (r *runner) notifyFailed(job *notifyJob, version string) error {
+	err := stageErr(stageNotify, fmt.Errorf("Notify command failed: %w", job.err))
+	log.Errorf("Template %s failed: %v", job.tmpl.Source, err)
+	r.reportError(job.tmpl, version, err)
+	job.record.fail(err)
+	return err
+}
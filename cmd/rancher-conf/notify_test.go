@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckNotifyOrder(t *testing.T) {
+	tmpl := func(name string, after ...string) Template {
+		return Template{Name: name, Source: "/templates/" + name + ".tmpl", NotifyAfter: after}
+	}
+
+	tests := []struct {
+		name      string
+		templates []Template
+		wantErr   string
+	}{
+		{"no order", []Template{tmpl("a"), tmpl("b")}, ""},
+		{"chain", []Template{tmpl("a", "b"), tmpl("b", "c"), tmpl("c")}, ""},
+		{"diamond", []Template{tmpl("a", "b", "c"), tmpl("b", "d"), tmpl("c", "d"), tmpl("d")}, ""},
+		{"by source", []Template{tmpl("a", "/templates/b.tmpl"), tmpl("b")}, ""},
+		{"unknown template", []Template{tmpl("a", "x")}, "unknown template 'x'"},
+		{"self", []Template{tmpl("a", "a")}, "Cycle in notify-after: a -> a"},
+		{"cycle", []Template{tmpl("a", "b"), tmpl("b", "c"), tmpl("c", "a")}, "Cycle in notify-after: a -> b -> c -> a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkNotifyOrder(tt.templates)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("checkNotifyOrder() error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("checkNotifyOrder() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunNotifyJobs(t *testing.T) {
+	type notifyTemplate struct {
+		name  string
+		after []string
+		fail  bool
+	}
+
+	tests := []struct {
+		name        string
+		concurrency int
+		templates   []notifyTemplate
+		wantRun     []string
+		wantPending []string
+	}{
+		{
+			"template order",
+			1,
+			[]notifyTemplate{{name: "a"}, {name: "b"}, {name: "c"}},
+			[]string{"a", "b", "c"},
+			nil,
+		},
+		{
+			"after other template",
+			1,
+			[]notifyTemplate{{name: "a", after: []string{"b"}}, {name: "b"}, {name: "c"}},
+			[]string{"b", "a", "c"},
+			nil,
+		},
+		{
+			"chain",
+			4,
+			[]notifyTemplate{{name: "a", after: []string{"b"}}, {name: "b", after: []string{"c"}}, {name: "c"}},
+			[]string{"c", "b", "a"},
+			nil,
+		},
+		{
+			"failed dependency",
+			1,
+			[]notifyTemplate{{name: "a", after: []string{"b"}}, {name: "b", fail: true}, {name: "c"}},
+			[]string{"b", "c"},
+			[]string{"a", "b"},
+		},
+		{
+			"failed dependency of dependency",
+			2,
+			[]notifyTemplate{{name: "a", after: []string{"b"}}, {name: "b", after: []string{"c"}}, {name: "c", fail: true}},
+			[]string{"c"},
+			[]string{"a", "b", "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "notify-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			logFile := filepath.Join(dir, "log")
+
+			templates := make([]Template, 0)
+			for _, nt := range tt.templates {
+				command := "echo " + nt.name + " >> " + logFile
+				if nt.fail {
+					command += "; exit 1"
+				}
+				templates = append(templates, Template{
+					Name:        nt.name,
+					Source:      nt.name + ".tmpl",
+					NotifyCmd:   Command{Argv: []string{"sh", "-c", command}},
+					NotifyAfter: nt.after,
+				})
+			}
+
+			r := &runner{
+				Config: &Config{Templates: templates, NotifyConcurrency: tt.concurrency},
+				Status: newRunnerStatus(templates),
+			}
+			jobs := make([]*notifyJob, 0)
+			for i, tmpl := range templates {
+				jobs = append(jobs, newNotifyJob(i, tmpl, r.Status.Templates[i], nil))
+			}
+			r.runNotifyJobs(jobs)
+
+			out, _ := ioutil.ReadFile(logFile)
+			if run := strings.Fields(string(out)); !reflect.DeepEqual(run, tt.wantRun) {
+				t.Errorf("notify commands run %v, want %v", run, tt.wantRun)
+			}
+
+			var pending []string
+			for i, job := range jobs {
+				if !job.finished {
+					t.Errorf("job %s not finished", job.tmpl.Name)
+				}
+				if r.Status.Templates[i].NotifyPending {
+					pending = append(pending, job.tmpl.Name)
+					if job.err == nil {
+						t.Errorf("pending job %s has no error", job.tmpl.Name)
+					}
+				}
+			}
+			if !reflect.DeepEqual(pending, tt.wantPending) {
+				t.Errorf("pending notify commands %v, want %v", pending, tt.wantPending)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// shellArgs are prepended to check and notify commands.
+var shellArgs = []string{"/bin/sh", "-c"}
+
+// copyOwnership sets the owner and group of path to the ones described
+// by fi.
+func copyOwnership(path string, fi os.FileInfo) error {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return os.Chown(path, int(stat.Uid), int(stat.Gid))
+	}
+	return nil
+}
+
+// setCommandCredentials makes cmd run as the given user and group. Both
+// may be names or numeric ids. If the group is omitted, the primary group
+// of the user is used.
+func setCommandCredentials(cmd *exec.Cmd, username, groupname string) error {
+	uid, gid := os.Getuid(), os.Getgid()
+
+	if username != "" {
+		var err error
+		if uid, gid, err = lookupUser(username); err != nil {
+			return err
+		}
+	}
+
+	if groupname != "" {
+		var err error
+		if gid, err = lookupGroup(groupname); err != nil {
+			return err
+		}
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	return nil
+}
+
+// setOwnership sets the owner and group of path. Both may be names or
+// numeric ids, empty values are left unchanged.
+func setOwnership(path, username, groupname string) error {
+	uid, gid := -1, -1
+
+	if username != "" {
+		var err error
+		if uid, _, err = lookupUser(username); err != nil {
+			return err
+		}
+	}
+
+	if groupname != "" {
+		var err error
+		if gid, err = lookupGroup(groupname); err != nil {
+			return err
+		}
+	}
+
+	return os.Chown(path, uid, gid)
+}
+
+// lookupUser returns the uid and primary gid of a user given by name or id.
+func lookupUser(username string) (int, int, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		if u, err = user.LookupId(username); err != nil {
+			return 0, 0, err
+		}
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(uid), int(gid), nil
+}
+
+// lookupGroup returns the gid of a group given by name or id.
+func lookupGroup(groupname string) (int, error) {
+	g, err := user.LookupGroup(groupname)
+	if err != nil {
+		if g, err = user.LookupGroupId(groupname); err != nil {
+			return 0, err
+		}
+	}
+	gid, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return int(gid), nil
+}
+
+// freeDiskSpace returns the number of bytes available to unprivileged users
+// on the filesystem of path.
+func freeDiskSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
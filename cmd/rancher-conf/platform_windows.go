@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"golang.org/x/sys/windows"
+)
+
+// shellArgs are prepended to check and notify commands.
+var shellArgs = []string{"cmd.exe", "/C"}
+
+// copyOwnership is a no-op on Windows. Files inherit the ACLs of the
+// directory they are created in.
+func copyOwnership(path string, fi os.FileInfo) error {
+	return nil
+}
+
+// setCommandCredentials is not supported on Windows.
+func setCommandCredentials(cmd *exec.Cmd, username, groupname string) error {
+	return fmt.Errorf("running commands as a different user is not supported on Windows")
+}
+
+// setOwnership is not supported on Windows.
+func setOwnership(path, username, groupname string) error {
+	return fmt.Errorf("setting the owner of files is not supported on Windows")
+}
+
+// freeDiskSpace returns the number of bytes available to the user on the
+// volume of path.
+func freeDiskSpace(path string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &free, nil, nil); err != nil {
+		return 0, err
+	}
+	return free, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pluginTypeExec = "exec"
+	pluginTypeGo   = "go"
+)
+
+// Plugin declares a source of additional template functions.
+type Plugin struct {
+	Name      string   `toml:"name"`
+	Path      string   `toml:"path"`
+	Type      string   `toml:"type"`
+	Functions []string `toml:"functions"`
+	Timeout   int      `toml:"timeout"`
+}
+
+// pluginRequest is written to the stdin of an exec plugin for every call.
+type pluginRequest struct {
+	Function string        `json:"function"`
+	Args     []interface{} `json:"args"`
+}
+
+// pluginResponse is read from the stdout of an exec plugin.
+type pluginResponse struct {
+	Result interface{} `json:"result"`
+	Error  string      `json:"error"`
+}
+
+// loadPlugins returns the template functions provided by all configured
+// plugins.
+func loadPlugins(plugins []Plugin) (template.FuncMap, error) {
+	funcs := template.FuncMap{}
+	for _, p := range plugins {
+		var loaded template.FuncMap
+		var err error
+
+		switch strings.ToLower(p.Type) {
+		case "", pluginTypeExec:
+			loaded, err = loadExecPlugin(p)
+		case pluginTypeGo:
+			loaded, err = loadGoPlugin(p)
+		default:
+			err = fmt.Errorf("unknown plugin type '%s'", p.Type)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Could not load plugin %s: %v", p.Name, err)
+		}
+
+		for name, fn := range loaded {
+			log.Debugf("Registering template function %s from plugin %s", name, p.Name)
+			funcs[name] = fn
+		}
+	}
+
+	return funcs, nil
+}
+
+// loadExecPlugin returns a template function for each function declared by
+// an exec plugin. Each call runs the plugin executable, writes a JSON encoded
+// pluginRequest to its stdin and expects a JSON encoded pluginResponse on its
+// stdout.
+func loadExecPlugin(p Plugin) (template.FuncMap, error) {
+	if p.Path == "" {
+		return nil, fmt.Errorf("missing path")
+	}
+	if len(p.Functions) == 0 {
+		return nil, fmt.Errorf("exec plugins must declare their functions")
+	}
+
+	timeout := time.Duration(p.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	funcs := template.FuncMap{}
+	for _, name := range p.Functions {
+		function := name
+		funcs[function] = func(args ...interface{}) (interface{}, error) {
+			return callExecPlugin(p.Path, timeout, function, args)
+		}
+	}
+
+	return funcs, nil
+}
+
+func callExecPlugin(path string, timeout time.Duration, function string, args []interface{}) (interface{}, error) {
+	if args == nil {
+		args = make([]interface{}, 0)
+	}
+
+	req, err := json.Marshal(pluginRequest{Function: function, Args: args})
+	if err != nil {
+		return nil, fmt.Errorf("(%s) could not encode arguments: %v", function, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdin = bytes.NewReader(req)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := runChild(cmd); err != nil {
+		return nil, fmt.Errorf("(%s) plugin failed: %v: %s", function, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var resp pluginResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("(%s) invalid plugin response: %v", function, err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("(%s) %s", function, resp.Error)
+	}
+
+	return resp.Result, nil
+}
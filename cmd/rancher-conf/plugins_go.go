@@ -0,0 +1,56 @@
+//go:build (linux && cgo) || (darwin && cgo)
+// +build linux,cgo darwin,cgo
+
+package main
+
+import (
+	"fmt"
+	"plugin"
+	"text/template"
+)
+
+// loadGoPlugin opens a Go plugin built with -buildmode=plugin. The plugin
+// must export a Funcs symbol, either a variable of type
+// map[string]interface{} or a function returning one. If the plugin config
+// lists functions, only those are registered.
+func loadGoPlugin(p Plugin) (template.FuncMap, error) {
+	plug, err := plugin.Open(p.Path)
+	if err != nil {
+		return nil, fmt.Errorf("%v. Go plugins must be built with the same Go version and dependencies as rancher-conf, "+
+			"which must be dynamically linked", err)
+	}
+
+	sym, err := plug.Lookup("Funcs")
+	if err != nil {
+		return nil, err
+	}
+
+	var exported map[string]interface{}
+	switch typed := sym.(type) {
+	case *map[string]interface{}:
+		exported = *typed
+	case *template.FuncMap:
+		exported = *typed
+	case func() map[string]interface{}:
+		exported = typed()
+	case func() template.FuncMap:
+		exported = typed()
+	default:
+		return nil, fmt.Errorf("unsupported type %T of symbol Funcs", sym)
+	}
+
+	if len(p.Functions) == 0 {
+		return template.FuncMap(exported), nil
+	}
+
+	funcs := template.FuncMap{}
+	for _, name := range p.Functions {
+		fn, ok := exported[name]
+		if !ok {
+			return nil, fmt.Errorf("function %s is not exported", name)
+		}
+		funcs[name] = fn
+	}
+
+	return funcs, nil
+}
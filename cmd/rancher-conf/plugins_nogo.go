@@ -0,0 +1,17 @@
+//go:build !((linux || darwin) && cgo)
+// +build !linux,!darwin !cgo
+
+package main
+
+import (
+	"fmt"
+	"text/template"
+)
+
+// Go plugins can only be loaded by dynamically linked linux and darwin
+// builds with cgo enabled, not by the release binaries and the Docker
+// image.
+func loadGoPlugin(p Plugin) (template.FuncMap, error) {
+	return nil, fmt.Errorf("Go plugins are not supported by this build of rancher-conf, " +
+		"they require a linux or darwin build with cgo enabled. Use an exec plugin instead")
+}
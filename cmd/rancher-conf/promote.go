@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stagedTemplate is the rendered content of a template and its staged
+// writes to the destinations that changed.
+type stagedTemplate struct {
+	content []byte
+	writes  []*stagedWrite
+}
+
+// templateResult is the outcome of processing a template in a cycle.
+type templateResult struct {
+	index  int
+	tmpl   Template
+	status *templateStatus
+	record *auditRecord
+	// staged is nil if the template failed or no destination changed
+	staged         *stagedTemplate
+	err            error
+	projectionHash string
+}
+
+// updated returns true if destinations of the template have been written.
+func (res *templateResult) updated() bool {
+	return res.err == nil && res.staged != nil
+}
+
+// promote writes the staged content of all templates of the cycle to their
+// destinations. If a destination can't be written, the destinations
+// written before are restored and all staged templates fail, so the
+// destinations of a cycle are updated together or not at all. Remote
+// destinations are written last, as their previous content can't be
+// restored.
+func (r *runner) promote(results []*templateResult) {
+	type promotion struct {
+		res *templateResult
+		w   *stagedWrite
+	}
+
+	staged := make([]*templateResult, 0)
+	local := make([]promotion, 0)
+	remote := make([]promotion, 0)
+	for _, res := range results {
+		if res.err != nil || res.staged == nil {
+			continue
+		}
+		staged = append(staged, res)
+		for _, w := range res.staged.writes {
+			if w.remote != nil {
+				remote = append(remote, promotion{res, w})
+			} else {
+				local = append(local, promotion{res, w})
+			}
+		}
+	}
+	defer func() {
+		for _, res := range staged {
+			for _, w := range res.staged.writes {
+				w.cleanup()
+			}
+		}
+	}()
+
+	committed := make([]promotion, 0)
+	for _, p := range append(local, remote...) {
+		log.Debugf("Writing destination %s", p.w.dest.Path)
+		if err := p.w.commit(p.res.staged.content); err != nil {
+			err = stageErr(stageWrite, fmt.Errorf("Could not write destination %s: %v", p.w.dest.Path, err))
+			for i := len(committed) - 1; i >= 0; i-- {
+				path := committed[i].w.dest.Path
+				if rerr := committed[i].w.rollback(); rerr != nil {
+					log.Errorf("Could not restore destination %s: %v", path, rerr)
+					continue
+				}
+				log.Warnf("Destination %s has been restored", path)
+			}
+			for _, res := range staged {
+				res.err = err
+				if res != p.res {
+					res.err = stageErr(stageWrite, fmt.Errorf("Destinations not updated, destination %s of template %s could not be written",
+						p.w.dest.Path, p.res.tmpl.Source))
+				}
+			}
+			return
+		}
+		committed = append(committed, p)
+	}
+
+	for _, res := range staged {
+		for _, w := range res.staged.writes {
+			log.Infof("Destination %s has been updated", w.dest.Path)
+			res.record.destination(w.dest.Path, w.old, res.staged.content)
+			r.summary.written(len(res.staged.content))
+		}
+		r.Manifest.add(res.tmpl, res.staged.content)
+
+		status := res.status
+		r.Status.update(func() {
+			status.LastUpdate = time.Now()
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type failingDestination struct{}
+
+func (failingDestination) Name() string                      { return "failing" }
+func (failingDestination) Same(content []byte) (bool, error) { return false, nil }
+func (failingDestination) Write(content []byte) error        { return errors.New("unavailable") }
+
+func TestPromote(t *testing.T) {
+	tests := []struct {
+		name       string
+		failRemote bool
+		wantA      string
+		wantB      string
+		wantFiles  int
+		wantErr    []string
+	}{
+		{"all destinations written", false, "new a", "new b", 2, []string{"", ""}},
+		{
+			"failed destination",
+			true,
+			"old a",
+			"",
+			1,
+			[]string{"Destinations not updated, destination failing://x of template b.tmpl", "Could not write destination failing://x"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "promote-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			pathA, pathB := filepath.Join(dir, "a.conf"), filepath.Join(dir, "b.conf")
+			if err := ioutil.WriteFile(pathA, []byte("old a"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			templates := []Template{{Source: "a.tmpl", Dest: pathA}, {Source: "b.tmpl", Dest: pathB}}
+			r := &runner{Config: &Config{Templates: templates}, Status: newRunnerStatus(templates)}
+
+			results := make([]*templateResult, 0)
+			for i, tmpl := range templates {
+				content := []byte("new " + strings.TrimSuffix(filepath.Base(tmpl.Dest), ".conf"))
+				w, err := r.stageDestination(tmpl, Destination{Path: tmpl.Dest}, content)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := w.prepare(); err != nil {
+					t.Fatal(err)
+				}
+				staged := &stagedTemplate{content: content, writes: []*stagedWrite{w}}
+				if i == 1 && tt.failRemote {
+					staged.writes = append(staged.writes, &stagedWrite{dest: Destination{Path: "failing://x"}, remote: failingDestination{}})
+				}
+				results = append(results, &templateResult{index: i, tmpl: tmpl, status: r.Status.Templates[i], staged: staged})
+			}
+
+			r.promote(results)
+
+			for i, res := range results {
+				switch {
+				case tt.wantErr[i] == "" && res.err != nil:
+					t.Errorf("template %d: error = %v", i, res.err)
+				case tt.wantErr[i] != "" && (res.err == nil || !strings.Contains(res.err.Error(), tt.wantErr[i])):
+					t.Errorf("template %d: error = %v, want %q", i, res.err, tt.wantErr[i])
+				}
+			}
+			if a, _ := ioutil.ReadFile(pathA); string(a) != tt.wantA {
+				t.Errorf("a.conf = %q, want %q", a, tt.wantA)
+			}
+			if b, _ := ioutil.ReadFile(pathB); string(b) != tt.wantB {
+				t.Errorf("b.conf = %q, want %q", b, tt.wantB)
+			}
+			if _, err := os.Stat(pathB); tt.wantB == "" && !os.IsNotExist(err) {
+				t.Error("b.conf has not been removed")
+			}
+
+			files, _ := ioutil.ReadDir(dir)
+			if len(files) != tt.wantFiles {
+				names := make([]string, 0)
+				for _, f := range files {
+					names = append(names, f.Name())
+				}
+				t.Errorf("staging files or backups left behind: %v", names)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os/exec"
+	"sync"
+)
+
+// childLock is held for reading while rancher-conf waits for its own child
+// processes and for writing while the reaper collects orphaned processes,
+// so that the reaper never collects the exit status of a command before
+// os/exec can.
+var childLock sync.RWMutex
+
+// runChild runs a command like cmd.Run.
+func runChild(cmd *exec.Cmd) error {
+	childLock.RLock()
+	defer childLock.RUnlock()
+	return cmd.Run()
+}
+
+// childOutput runs a command like cmd.Output.
+func childOutput(cmd *exec.Cmd) ([]byte, error) {
+	childLock.RLock()
+	defer childLock.RUnlock()
+	return cmd.Output()
+}
+
+// childCombinedOutput runs a command like cmd.CombinedOutput.
+func childCombinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	childLock.RLock()
+	defer childLock.RUnlock()
+	return cmd.CombinedOutput()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// startReaper collects the exit status of orphaned processes if rancher-conf
+// runs as PID 1 of a container or subreaper is set. Orphans, e.g. processes
+// daemonized by notify commands, are reparented to rancher-conf and would
+// otherwise remain as zombies.
+func startReaper(subreaper bool) {
+	if os.Getpid() != 1 {
+		if !subreaper {
+			return
+		}
+		if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+			log.Warnf("Could not become a subreaper: %v", err)
+			return
+		}
+	}
+
+	log.Debug("Reaping orphaned child processes")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGCHLD)
+
+	go func() {
+		for range signals {
+			reapChildren()
+		}
+	}()
+	// orphans may have been reparented before the handler was installed
+	reapChildren()
+}
+
+// reapChildren collects all terminated child processes. It waits until no
+// command started by rancher-conf is running.
+func reapChildren() {
+	childLock.Lock()
+	defer childLock.Unlock()
+
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if pid <= 0 || err != nil {
+			return
+		}
+		log.Debugf("Reaped orphaned process %d (%v)", pid, status)
+	}
+}
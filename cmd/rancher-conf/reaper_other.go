@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import log "github.com/sirupsen/logrus"
+
+// Orphaned processes are only reaped on Linux.
+func startReaper(subreaper bool) {
+	if subreaper {
+		log.Warn("subreaper is only supported on Linux")
+	}
+}
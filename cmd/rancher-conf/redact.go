@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// redactedText replaces redacted secrets.
+	redactedText = "[REDACTED]"
+	// minSecretLength is the minimum length of masked secret values, so
+	// that short values don't mask every occurrence of common words.
+	minSecretLength = 4
+)
+
+// redactor masks secrets in log messages, command output and error
+// reports. Secrets are matched by the configured patterns or registered as
+// values, e.g. by the template functions reading secrets.
+type redactor struct {
+	mu       sync.RWMutex
+	patterns []*regexp.Regexp
+	values   []string
+}
+
+// secrets is the redactor applied to all logs and reports.
+var secrets = &redactor{}
+
+// addPatterns compiles redaction patterns. If a pattern contains groups,
+// only the text matched by the groups is redacted, e.g. the password in
+// 'password=(\S+)'.
+func (r *redactor) addPatterns(patterns []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid redaction pattern '%s': %v", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return nil
+}
+
+// addValue registers a secret value that is masked wherever it appears.
+func (r *redactor) addValue(value string) {
+	value = strings.TrimSpace(value)
+	if len(value) < minSecretLength {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if containsString(r.values, value) {
+		return
+	}
+	r.values = append(r.values, value)
+	// longer values first, so values containing others are masked entirely
+	sort.Slice(r.values, func(i, j int) bool { return len(r.values[i]) > len(r.values[j]) })
+}
+
+// redact returns s with all secrets masked.
+func (r *redactor) redact(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, value := range r.values {
+		s = strings.Replace(s, value, redactedText, -1)
+	}
+	for _, re := range r.patterns {
+		s = redactMatches(re, s)
+	}
+	return s
+}
+
+// redactMatches replaces the matches of re in s, or only the text matched
+// by its groups.
+func redactMatches(re *regexp.Regexp, s string) string {
+	if re.NumSubexp() == 0 {
+		return re.ReplaceAllLiteralString(s, redactedText)
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, match := range re.FindAllStringSubmatchIndex(s, -1) {
+		for g := 1; g <= re.NumSubexp(); g++ {
+			start, end := match[2*g], match[2*g+1]
+			if start < last || start < 0 {
+				continue
+			}
+			b.WriteString(s[last:start])
+			b.WriteString(redactedText)
+			last = end
+		}
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// redactingFormatter masks secrets in the message and fields of log entries
+// before they are formatted.
+type redactingFormatter struct {
+	log.Formatter
+}
+
+func (f *redactingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	redacted := *entry
+	redacted.Message = secrets.redact(entry.Message)
+	redacted.Data = make(log.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			value = secrets.redact(v)
+		case error:
+			value = secrets.redact(v.Error())
+		}
+		redacted.Data[key] = value
+	}
+	return f.Formatter.Format(&redacted)
+}
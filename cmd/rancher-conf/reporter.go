@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxReportedOutput limits the command output included in error reports.
+const maxReportedOutput = 4096
+
+// errorEvent describes a failure reported to the error reporters.
+type errorEvent struct {
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host"`
+	Version  string    `json:"version"`
+	Template string    `json:"template"`
+	Stage    string    `json:"stage"`
+	Error    string    `json:"error"`
+	Output   string    `json:"output,omitempty"`
+}
+
+// errorReporter sends failures to an external service.
+type errorReporter interface {
+	Report(ev errorEvent) error
+}
+
+// newErrorReporters returns the reporters configured by conf.
+func newErrorReporters(conf *Config) ([]errorReporter, error) {
+	reporters := make([]errorReporter, 0)
+
+	if conf.ReportWebhook != "" {
+		reporters = append(reporters, &webhookReporter{url: conf.ReportWebhook})
+	}
+
+	if conf.SentryDSN != "" {
+		sentry, err := newSentryReporter(conf.SentryDSN)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Sentry DSN: %v", err)
+		}
+		reporters = append(reporters, sentry)
+	}
+
+	return reporters, nil
+}
+
+// reportError sends a template failure to all configured reporters. Reports
+// are sent in the background and failures to send them are only logged.
+// Before exiting, the runner waits for pending reports.
+func (r *runner) reportError(t Template, version string, err error) {
+	if len(r.Reporters) == 0 {
+		return
+	}
+
+	host, _ := os.Hostname()
+	ev := errorEvent{
+		Time:     time.Now().UTC(),
+		Host:     host,
+		Version:  version,
+		Template: t.Source,
+		Error:    secrets.redact(err.Error()),
+	}
+
+	var serr *stageError
+	if errors.As(err, &serr) {
+		ev.Stage = serr.Stage
+	}
+
+	var cerr *commandError
+	if errors.As(err, &cerr) {
+		ev.Output = secrets.redact(truncateOutput(cerr.Output))
+	}
+
+	for _, reporter := range r.Reporters {
+		r.reports.Add(1)
+		go func(reporter errorReporter) {
+			defer r.reports.Done()
+			if err := reporter.Report(ev); err != nil {
+				log.Warnf("Could not report error: %v", err)
+			}
+		}(reporter)
+	}
+}
+
+// truncateOutput returns the last maxReportedOutput bytes of the output,
+// which usually contain the reason of the failure.
+func truncateOutput(output []byte) string {
+	if len(output) <= maxReportedOutput {
+		return string(output)
+	}
+	return "..." + string(output[len(output)-maxReportedOutput:])
+}
+
+// postJSON sends v JSON encoded to the URL.
+func postJSON(u string, header http.Header, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "application/json")
+
+	buf, code, err := remoteRequest("POST", u, header, body)
+	if err != nil {
+		return err
+	}
+	if code < 200 || code > 299 {
+		return fmt.Errorf("%s: %s", http.StatusText(code), strings.TrimSpace(string(buf)))
+	}
+	return nil
+}
+
+// webhookReporter posts the JSON encoded errorEvent to a URL.
+type webhookReporter struct {
+	url string
+}
+
+func (w *webhookReporter) Report(ev errorEvent) error {
+	return postJSON(w.url, nil, ev)
+}
+
+// sentryReporter sends events to the store endpoint of a Sentry project.
+type sentryReporter struct {
+	storeUrl  string
+	publicKey string
+}
+
+// newSentryReporter parses a DSN in the form
+// https://<key>@<host>/<project>.
+func newSentryReporter(dsn string) (*sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("missing public key")
+	}
+
+	i := strings.LastIndex(u.Path, "/")
+	project := u.Path[i+1:]
+	if project == "" {
+		return nil, fmt.Errorf("missing project id")
+	}
+
+	return &sentryReporter{
+		storeUrl:  fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, u.Path[:i], project),
+		publicKey: u.User.Username(),
+	}, nil
+}
+
+func (s *sentryReporter) Report(ev errorEvent) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	event := map[string]interface{}{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   ev.Time.Format("2006-01-02T15:04:05"),
+		"level":       "error",
+		"logger":      "rancher-conf",
+		"platform":    "go",
+		"server_name": ev.Host,
+		"release":     Version,
+		"message":     fmt.Sprintf("Template %s failed: %s", ev.Template, ev.Error),
+		"tags": map[string]string{
+			"template": ev.Template,
+			"stage":    ev.Stage,
+		},
+		"extra": map[string]string{
+			"metadata_version": ev.Version,
+			"output":           ev.Output,
+		},
+	}
+
+	header := http.Header{}
+	header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=rancher-conf/%s, sentry_key=%s", Version, s.publicKey))
+
+	return postJSON(s.storeUrl, header, event)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// requireSkip skips a template whose required services are missing.
+	requireSkip = "skip"
+	// requireHold defers rendering of all templates while the required
+	// services of a template are missing.
+	requireHold = "hold"
+)
+
+// checkRequireMode returns an error if mode is not supported.
+func checkRequireMode(mode string) error {
+	switch mode {
+	case "", requireSkip, requireHold:
+		return nil
+	}
+	return fmt.Errorf("Unsupported require-mode '%s'", mode)
+}
+
+// holdsRendering returns true if the template defers the rendering of all
+// templates while its required services are missing.
+func (t Template) holdsRendering() bool {
+	return len(t.Requires) > 0 && t.RequireMode == requireHold
+}
+
+// missingRequired returns the services of refs that don't exist or have no
+// running container. Services are identified as 'stack-name/service-name'
+// or 'service-name[.stack-name]', services without stack name are looked
+// up in the stack of the self container.
+func (c *TemplateContext) missingRequired(refs []string) []string {
+	missing := make([]string, 0)
+	for _, ref := range refs {
+		service, stack := parseServiceRef(ref, c.Self.stackName())
+
+		running := false
+		for _, s := range c.Services {
+			if !strings.EqualFold(s.Name, service) || !strings.EqualFold(s.Stack.Name, stack) {
+				continue
+			}
+			for _, ct := range s.Containers {
+				if ct.State == "running" {
+					running = true
+					break
+				}
+			}
+		}
+		if !running {
+			missing = append(missing, ref)
+		}
+	}
+	return missing
+}
+
+// parseServiceRef splits a service reference in the form
+// 'stack-name/service-name' or 'service-name[.stack-name]' into the names
+// of the service and stack. defaultStack is returned for references without
+// stack name.
+func parseServiceRef(ref, defaultStack string) (service, stack string) {
+	if i := strings.Index(ref, "/"); i >= 0 {
+		return ref[i+1:], ref[:i]
+	}
+	if i := strings.Index(ref, "."); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, defaultStack
+}
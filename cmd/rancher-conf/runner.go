@@ -3,19 +3,24 @@ package main
 import (
   "bytes"
   "crypto/md5"
+  "encoding/json"
+  "errors"
   "fmt"
   "io"
   "io/ioutil"
-  "net/url"
+  "net"
   "os"
   "os/exec"
-  "path"
   "path/filepath"
   "strings"
   "syscall"
   "text/template"
+  "time"
   "sort"
+  "strconv"
+  "sync"
 
+  "github.com/coreos/go-systemd/v22/daemon"
   log "github.com/sirupsen/logrus"
   "github.com/finboxio/go-rancher-metadata/metadata"
 )
@@ -23,205 +28,927 @@ import (
 type runner struct {
   Config  *Config
   Client  metadata.Client
+  Plugins template.FuncMap
+  Cache   *templateCache
+  Status  *runnerStatus
+  Audit   *auditLog
+  Events  *eventSubscriber
+  Secrets *secretStore
+  Manifest *manifest
+  Reporters []errorReporter
+  // clients of the additional environments
+  Environments []*environmentClient
+
+  // error reports that are being sent
+  reports sync.WaitGroup
+
+  // audit record of the template being processed, nil if the audit log
+  // is disabled
+  record *auditRecord
+  // statistics of the cycle being processed
+  summary *cycleSummary
+  // runner information exposed to the templates of the cycle being
+  // processed
+  info RunnerInfo
+
+  // hash of the context rendered by the last successful cycle
+  lastContextHash string
+  // hashes of the projected contexts or memoize-keys last rendered
+  // successfully by memoized templates, by template index
+  projectionHashes map[int]string
+  // parsed memoize-keys by template index
+  memoizeKeys map[int]*template.Template
+  // number of failed cycles since the last successful one
+  consecutiveFailures int
+  // set if rendering of the last version has been deferred
+  deferred bool
+  // fingerprints of the paths watched by templates
+  watched map[string]string
 }
 
 func NewRunner(conf *Config) (*runner, error) {
-  u, _ := url.Parse(conf.MetadataUrl)
-  u.Path = path.Join(u.Path, conf.MetadataVersion)
-
   log.Infof("Initializing Rancher Metadata client (version %s)", conf.MetadataVersion)
 
-  client, err := metadata.NewClientAndWait(u.String())
+  plugins, err := loadPlugins(conf.Plugins)
+  if err != nil {
+    return nil, err
+  }
+
+  var audit *auditLog
+  if conf.AuditLog != "" {
+    if audit, err = openAuditLog(conf.AuditLog); err != nil {
+      return nil, fmt.Errorf("Could not open audit log: %v", err)
+    }
+  }
+
+  reporters, err := newErrorReporters(conf)
   if err != nil {
-    return nil, fmt.Errorf("Failed to initialize Rancher Metadata client: %v", err)
+    return nil, err
   }
 
-  return &runner{
+  files, err := loadManifest(conf.Manifest)
+  if err != nil {
+    return nil, err
+  }
+
+  var events *eventSubscriber
+  if conf.Events && !conf.OneTime {
+    if events, err = newEventSubscriber(conf); err != nil {
+      return nil, err
+    }
+  }
+
+  environments := newEnvironmentClients(conf)
+
+  client, version, err := metadataClient(conf.MetadataUrl, conf.MetadataVersion, metadataWait(conf))
+  if err != nil {
+    if conf.MetadataFallback != metadataDegraded || conf.OneTime {
+      return nil, fmt.Errorf("Failed to initialize Rancher Metadata client: %v", err)
+    }
+    // the client is created by Run, after the admin API has been started
+    log.Warnf("Metadata service is unavailable: %v. Starting degraded", err)
+    client = nil
+  } else {
+    conf.MetadataVersion = version
+  }
+
+  r := &runner{
     Config:   conf,
     Client:   client,
-  }, nil
+    Plugins:  plugins,
+    Cache:    newTemplateCache(),
+    projectionHashes: make(map[int]string),
+    memoizeKeys: make(map[int]*template.Template),
+    watched:  make(map[string]string),
+    Status:   newRunnerStatus(conf.Templates),
+    Audit:    audit,
+    Events:   events,
+    Secrets:  newSecretStore(conf.SecretsDir),
+    Manifest: files,
+    Reporters: reporters,
+    Environments: environments,
+  }
+  if err := r.parseMemoizeKeys(); err != nil {
+    return nil, err
+  }
+  return r, nil
+}
+
+// cycleResult summarizes the processing of a metadata version.
+type cycleResult struct {
+  // number of destinations that have been updated
+  Updated int
+  // number of templates that failed, or -1 if the context could not be built
+  Failed  int
+  // processing stages in which errors occurred
+  Stages  []string
+  // set if rendering has been deferred because the metadata is
+  // inconsistent and require-consistent is enabled
+  Deferred bool
+}
+
+// maxNotifyBackoff limits the delay between retries of notify commands.
+const maxNotifyBackoff = time.Minute
+
+// Processing stages used to classify errors.
+const (
+  stageMetadata = "metadata"
+  stageScript   = "script"
+  stageRender   = "render"
+  stageCheck    = "check"
+  stageWrite    = "write"
+  stageNotify   = "notify"
+  stageCommand  = "command"
+)
+
+var stages = []string{stageMetadata, stageScript, stageRender, stageCheck, stageWrite, stageNotify, stageCommand}
+
+// stageError annotates an error with the processing stage it occurred in.
+type stageError struct {
+  Stage string
+  Err   error
+}
+
+func (e *stageError) Error() string {
+  return e.Err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+  return e.Err
 }
 
-func (r *runner) Run() error {
+func stageErr(stage string, err error) error {
+  return &stageError{Stage: stage, Err: err}
+}
+
+// Run processes templates until the process is terminated. In onetime mode
+// all templates are processed once and the exit code for the process is
+// returned: 0 if nothing changed, the configured changed-exit-code if any
+// destination has been updated and 1 if processing failed.
+func (r *runner) Run() (int, error) {
+  cleanupStagingFiles(r.Config.Templates, r.Config.StagingDir)
+
+  if r.Config.AdminAddr != "" {
+    startAdminServer(r.Config.AdminAddr, r.Status)
+  }
+
+  if r.Client == nil {
+    r.connectMetadata()
+  }
+
   if r.Config.OneTime {
+    if err := r.waitSettled(r.Config.Interval, false); err != nil {
+      return 1, fmt.Errorf("Could not wait for metadata to settle: %v", err)
+    }
+    if err := r.waitForCondition(r.Config.Interval, false); err != nil {
+      return 1, err
+    }
+    if len(r.Config.Templates) == 0 {
+      log.Info("No templates to process. Exiting.")
+      return 0, nil
+    }
     log.Info("Processing all templates once.")
-    r.processVersion("init")
+    result := r.processVersion("init")
+    r.reports.Wait()
+    if result.Deferred {
+      log.Error("Metadata is inconsistent or required services are missing. Exiting without rendering templates.")
+      return 1, nil
+    }
     log.Info("All templates processed. Exiting.")
-    return nil
+
+    if result.Failed != 0 {
+      return 1, nil
+    }
+    if result.Updated > 0 {
+      return r.Config.ChangedExitCode, nil
+    }
+    return 0, nil
   }
 
-  r.Client.OnChange(r.Config.Interval, func (version string) {
-    r.processVersion(version)
-    log.Infof("Processed version %s. Waiting for next update...", version)
-  })
+  // With the systemd watchdog enabled, a ping is sent in every cycle, so
+  // cycles must not take longer than half of the watchdog timeout.
+  wait := r.Config.Interval
+  watchdog := sdWatchdogInterval()
+  if watchdog > 0 {
+    if half := int(watchdog / 2 / time.Second); half < wait {
+      wait = half
+    }
+    if wait < 1 {
+      wait = 1
+    }
+  }
 
-  return nil
+  // With events, the metadata version is checked on every change event and
+  // polled every interval as a safety net.
+  poll := r.waitVersion
+  if r.Events != nil {
+    go r.Events.run()
+    poll = r.waitEvent
+  }
+
+  if err := r.waitSettled(wait, watchdog > 0); err != nil {
+    return 1, fmt.Errorf("Could not wait for metadata to settle: %v", err)
+  }
+  if err := r.waitForCondition(wait, watchdog > 0); err != nil {
+    return 1, err
+  }
+  if len(r.Config.Templates) == 0 {
+    log.Info("No templates to process. Exiting.")
+    return 0, nil
+  }
+
+  // the first cycle renders all templates anyway
+  r.changedWatchPaths()
+  r.changedEnvironments()
+
+  version := "init"
+  ready := false
+  for {
+    if watchdog > 0 {
+      sdNotify(daemon.SdNotifyWatchdog)
+    }
+
+    newVersion, err := poll(version, wait)
+    if err != nil {
+      log.Errorf("Error reading metadata version: %v", err)
+      r.checkFailures(cycleResult{Failed: -1, Stages: []string{stageMetadata}})
+      time.Sleep(time.Duration(wait) * time.Second)
+      continue
+    }
+
+    changed := append(r.Secrets.changed(), r.changedWatchPaths()...)
+    if len(changed) > 0 {
+      // templates are rendered again even though the context is unchanged
+      log.Infof("Files changed: %s", strings.Join(changed, ", "))
+      r.lastContextHash = ""
+      r.projectionHashes = make(map[int]string)
+    }
+
+    environments := r.changedEnvironments()
+    if len(environments) > 0 {
+      log.Infof("Metadata of environments changed: %s", strings.Join(environments, ", "))
+    }
+
+    if newVersion == version && !r.deferred && len(changed) == 0 && len(environments) == 0 {
+      log.Debug("No changes in metadata version")
+      r.retryNotify()
+      continue
+    }
+
+    if len(changed) > 0 || len(environments) > 0 {
+      log.Debugf("Rendering version %s again", version)
+    } else if newVersion == version {
+      log.Debugf("Retrying deferred version %s", version)
+    } else {
+      log.Debugf("Metadata Version has been changed. Old version: %s. New version: %s.", version, newVersion)
+    }
+    version = newVersion
+    result := r.processVersion(version)
+    r.deferred = result.Deferred
+    r.checkFailures(result)
+    if result.Deferred {
+      log.Infof("Deferred version %s until the metadata is consistent and required services are present", version)
+    } else {
+      log.Infof("Processed version %s. Waiting for next update...", version)
+    }
+
+    if !ready {
+      sdNotify(daemon.SdNotifyReady)
+      r.Status.update(func() {
+        r.Status.Ready = true
+      })
+      ready = true
+    }
+    sdNotify(fmt.Sprintf("STATUS=Processed version %s", version))
+  }
 }
 
-func (r *runner) processVersion (version string) {
-  ctx, err := r.createContext()
+// waitVersion blocks until the metadata version differs from the given
+// version or maxWait seconds elapsed, and returns the current version.
+func (r *runner) waitVersion(version string, maxWait int) (string, error) {
+  resp, err := r.Client.SendRequest(fmt.Sprintf("/version?wait=true&value=%s&maxWait=%d", version, maxWait))
   if err != nil {
-    log.Errorf("Failed to create context from Rancher Metadata: %v", err)
+    if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+      return version, nil
+    }
+    return "", err
+  }
+
+  err = json.Unmarshal(resp, &version)
+  return version, err
+}
+
+// checkFailures terminates the process if the result of the last cycle
+// violates the configured failure policy.
+func (r *runner) checkFailures(result cycleResult) {
+  if result.Deferred {
     return
   }
 
-  tmplFuncs := newFuncMap(ctx)
+  if result.Failed == 0 {
+    r.consecutiveFailures = 0
+    return
+  }
+
+  r.consecutiveFailures++
+
+  for _, stage := range result.Stages {
+    for _, exitStage := range r.Config.ExitOnError {
+      if exitStage == stage || exitStage == "any" {
+        r.reports.Wait()
+        log.Fatalf("Exiting after %s failure", stage)
+      }
+    }
+  }
+
+  if r.Config.MaxFailures > 0 && r.consecutiveFailures >= r.Config.MaxFailures {
+    r.reports.Wait()
+    log.Fatalf("Exiting after %d consecutive failed cycles", r.consecutiveFailures)
+  }
+}
+
+func (r *runner) processVersion (version string) (result cycleResult) {
+  r.summary = newCycleSummary(version)
+  defer func() {
+    r.summary.finish(result, len(r.Config.Templates))
+    summary := r.summary
+    r.Status.update(func() {
+      r.Status.LastSummary = summary
+    })
+    r.summary = nil
+  }()
+
+  ctx, report, err := r.createContext()
+  if err != nil {
+    log.Errorf("Failed to create context from Rancher Metadata: %v", err)
+    result.Failed = -1
+    result.Stages = append(result.Stages, stageMetadata)
+    return result
+  }
+
+  r.Status.update(func() {
+    r.Status.Inconsistencies = report.Problems
+  })
+  if !report.Consistent() {
+    log.Warnf("Metadata of version %s is inconsistent: %s", version, strings.Join(report.Problems, "; "))
+    if r.Config.RequireConsistent {
+      result.Deferred = true
+      return result
+    }
+  }
+
+  if r.Config.ContextScript != "" {
+    if err := runContextScript(r.Config.ContextScript, ctx); err != nil {
+      log.Errorf("Context script %s failed: %v", r.Config.ContextScript, err)
+      result.Failed = -1
+      result.Stages = append(result.Stages, stageScript)
+      return result
+    }
+  }
+
   for _, tmpl := range r.Config.Templates {
-    if err := r.processTemplate(tmplFuncs, tmpl); err != nil {
+    if !tmpl.holdsRendering() || !tmpl.enabledFor(ctx.Self) {
+      continue
+    }
+    if missing := ctx.missingRequired(tmpl.Requires); len(missing) > 0 {
+      log.Warnf("Required services of template %s are missing: %s", tmpl.Source, strings.Join(missing, ", "))
+      result.Deferred = true
+      return result
+    }
+  }
+
+  hash, err := r.cycleHash(ctx)
+  if err != nil {
+    log.Warnf("Could not compute context checksum: %v", err)
+  } else if hash == r.lastContextHash && !r.Config.AlwaysRender {
+    log.Debugf("Context of version %s is unchanged. Skipping templates", version)
+    r.summary.skipped(len(r.Config.Templates))
+    r.Status.update(func() {
+      r.Status.Version = version
+      r.Status.LastCycle = time.Now()
+    })
+    r.retryNotify()
+    return result
+  }
+
+  // unchanged contexts are not written again
+  r.writeSnapshot(version, ctx)
+
+  tmplFuncs := r.funcMap(ctx)
+  r.info = r.newRunnerInfo(version)
+
+  // all templates are rendered and staged before the first destination is
+  // promoted, see promote
+  results := make([]*templateResult, 0)
+  for i, tmpl := range r.Config.Templates {
+    status := r.Status.Templates[i]
+
+    if !tmpl.enabledFor(ctx.Self) {
+      log.Debugf("Template %s is disabled by enabled-when-label '%s'", tmpl.name(), tmpl.EnabledWhen)
+      r.summary.skipped(1)
+      continue
+    }
+
+    if len(tmpl.Requires) > 0 && !tmpl.holdsRendering() {
+      if missing := ctx.missingRequired(tmpl.Requires); len(missing) > 0 {
+        log.Warnf("Skipping template %s, required services are missing: %s", tmpl.Source, strings.Join(missing, ", "))
+        r.summary.skipped(1)
+        continue
+      }
+    }
+
+    tmplCtx, funcs := ctx, tmplFuncs
+    if version := r.contextVersion(tmpl); version != ctx.version {
+      tmplCtx = r.contextForVersion(ctx, version)
+      funcs = r.funcMap(tmplCtx)
+    }
+    if tmpl.hasProjection() {
+      tmplCtx = tmplCtx.project(tmpl.Stacks, tmpl.Services)
+    }
+    projectionHash := ""
+    if tmpl.memoized() {
+      projectionHash, err = r.inputHash(i, tmpl, tmplCtx)
+      if err != nil {
+        log.Warnf("Could not compute context checksum of template %s: %v", tmpl.Source, err)
+      } else if projectionHash == r.projectionHashes[i] && !r.Config.AlwaysRender {
+        log.Debugf("Context of template %s is unchanged. Skipping", tmpl.Source)
+        r.summary.skipped(1)
+        continue
+      }
+    }
+    if tmpl.hasProjection() {
+      funcs = r.funcMap(tmplCtx)
+    }
+    delete(r.projectionHashes, i)
+
+    r.record = r.Audit.newRecord(version, tmpl)
+    staged, err := r.processTemplate(tmplCtx, funcs, tmpl)
+    results = append(results, &templateResult{
+      index:          i,
+      tmpl:           tmpl,
+      status:         status,
+      record:         r.record,
+      staged:         staged,
+      err:            err,
+      projectionHash: projectionHash,
+    })
+  }
+  r.record = nil
+
+  r.promote(results)
+
+  // audit records are written once the notify commands ran
+  records := make([]*auditRecord, 0)
+  notifications := make([]*notifyJob, 0)
+  for _, res := range results {
+    i, tmpl, status, err := res.index, res.tmpl, res.status, res.err
+    updated := res.updated()
+    res.record.fail(err)
+    if updated {
+      result.Updated++
+    }
+
+    var diskErr *diskSpaceError
+    r.Status.update(func() {
+      status.LastError = ""
+      if err != nil {
+        status.LastError = secrets.redact(err.Error())
+      }
+      status.LowDiskSpace = errors.As(err, &diskErr)
+    })
+
+    if err != nil {
+      result.Failed++
       log.Errorf("Template %s failed: %v", tmpl.Source, err)
-    } else {
-      if tmpl.UpdateCmd != "" {
-        if err := post(tmpl.UpdateCmd); err != nil {
-          log.Errorf("Version command failed: %v", err)
+      r.reportError(tmpl, version, err)
+
+      var serr *stageError
+      if errors.As(err, &serr) {
+        result.Stages = append(result.Stages, serr.Stage)
+      }
+
+      var terr *TemplateError
+      if errors.As(err, &terr) {
+        for _, line := range terr.Snippet() {
+          log.Error(line)
         }
       }
+      records = append(records, res.record)
+      continue
     }
+
+    if res.projectionHash != "" {
+      r.projectionHashes[i] = res.projectionHash
+    }
+
+    if tmpl.hasNotify() && (updated || r.Status.notifyPending(status)) {
+      if !updated {
+        log.Infof("Retrying pending notify command for %s", tmpl.Source)
+      }
+      notifications = append(notifications, newNotifyJob(i, tmpl, status, res.record))
+    }
+
+    if !tmpl.UpdateCmd.IsEmpty() {
+      err := post(tmpl, tmpl.UpdateCmd)
+      res.record.command(stageCommand, tmpl.UpdateCmd.String(), err)
+      if err != nil {
+        result.Failed++
+        result.Stages = append(result.Stages, stageCommand)
+        log.Errorf("Version command failed: %v", err)
+        r.reportError(tmpl, version, stageErr(stageCommand, err))
+      }
+    }
+    records = append(records, res.record)
+  }
+
+  r.runNotifyJobs(notifications)
+  for _, job := range notifications {
+    if job.err == nil {
+      continue
+    }
+    err := r.notifyFailed(job, version)
+    result.Failed++
+    result.Stages = append(result.Stages, stageNotify)
+    // the template is rendered again, like templates that failed earlier
+    delete(r.projectionHashes, job.index)
+    r.Status.update(func() {
+      job.status.LastError = secrets.redact(err.Error())
+    })
+  }
+  for _, rec := range records {
+    r.Audit.write(rec)
+  }
+
+  // orphaned files are only removed after a cycle without failures, once
+  // the files replacing them are in place
+  if r.Config.CleanupOrphans && result.Failed == 0 {
+    r.Manifest.removeOrphans(r.Config.OwnedPaths)
+  }
+  if err := r.Manifest.save(); err != nil {
+    log.Warn(err.Error())
+  }
+
+  r.Status.update(func() {
+    r.Status.Version = version
+    r.Status.LastCycle = time.Now()
+  })
+
+  // Templates are only skipped if all of them were rendered successfully
+  // for the same context, so failed templates are retried on every version.
+  if result.Failed > 0 {
+    r.lastContextHash = ""
+  } else {
+    r.lastContextHash = hash
+  }
+
+  return result
+}
+
+// funcMap returns the template functions for the context, including the
+// functions of plugins.
+func (r *runner) funcMap(ctx *TemplateContext) template.FuncMap {
+  funcs := newFuncMap(ctx)
+  funcs["secretFile"] = r.Secrets.read
+  for name, fn := range r.Plugins {
+    funcs[name] = fn
   }
+  return funcs
 }
 
-func (r *runner) processTemplate(funcs template.FuncMap, t Template) error {
-  log.Debugf("Processing template %s for destination %s", t.Source, t.Dest)
+// processTemplate renders the template and stages and checks the content
+// of the destinations that changed. The staged content is written to the
+// destinations by promote. It returns nil if no destination changed.
+func (r *runner) processTemplate(ctx *TemplateContext, funcs template.FuncMap, t Template) (staged *stagedTemplate, err error) {
+  log.Debugf("Processing template %s", t.Source)
   if _, err := os.Stat(t.Source); os.IsNotExist(err) {
-    log.Fatalf("Template '%s' is missing", t.Source)
+    return nil, stageErr(stageRender, fmt.Errorf("Template '%s' is missing", t.Source))
   }
 
-  tmplBytes, err := ioutil.ReadFile(t.Source)
+  entry, err := r.Cache.Load(t.Source)
   if err != nil {
-    log.Fatalf("Could not read template '%s': %v", t.Source, err)
+    return nil, stageErr(stageRender, fmt.Errorf("Could not read template '%s': %v", t.Source, err))
   }
 
-  name := filepath.Base(t.Source)
-  newTemplate := template.New(name)
-  // copied from: https://github.com/helm/helm/blob/8648ccf5d35d682dcd5f7a9c2082f0aaf071e817/pkg/engine/engine.go#L147-L154
-  funcs["include"] = func(name string, data interface{}) (string, error) {
-      buf := bytes.NewBuffer(nil)
-      if err := newTemplate.ExecuteTemplate(buf, name, data); err != nil {
-          return "", err
-      }
-      return buf.String(), nil
+  if err := t.Schema.validate(ctx); err != nil {
+    return nil, stageErr(stageMetadata, err)
   }
 
-  newTemplate, err = newTemplate.Funcs(funcs).Parse(string(tmplBytes))
+  content, err := r.renderTemplate(ctx, funcs, t, entry)
   if err != nil {
-    log.Fatalf("Could not parse template '%s': %v", t.Source, err)
+    return nil, stageErr(stageRender, err)
+  }
+  r.summary.rendered()
+
+  if !t.PostProcess.IsEmpty() {
+    content, err = postProcess(t, t.PostProcess, content)
+    r.record.command(stageRender, t.PostProcess.String(), err)
+    if err != nil {
+      return nil, stageErr(stageRender, fmt.Errorf("Post-process command failed: %w", err))
+    }
   }
 
-  buf := new(bytes.Buffer)
-  if err := newTemplate.Execute(buf, nil); err != nil {
-    log.Fatalf("Could not render template: '%s': %v", t.Source, err)
+  if err := validateContent(content, t.Validate); err != nil {
+    return nil, stageErr(stageCheck, err)
   }
 
-  content := buf.Bytes()
+  if content, err = compressContent(content, t.Compress); err != nil {
+    return nil, stageErr(stageRender, fmt.Errorf("Could not compress content: %v", err))
+  }
 
-  if t.Dest == "" {
+  dests := t.destinations()
+  if len(dests) == 0 {
     log.Debug("No destination specified. Printing to StdOut")
     os.Stdout.Write(content)
-    return nil
+    return nil, nil
   }
 
-  log.Debug("Checking whether content has changed")
-  same, err := sameContent(content, t.Dest)
-  if err != nil {
-    return fmt.Errorf("Could not compare content for %s: %v", t.Dest, err)
+  writes := make([]*stagedWrite, 0)
+  defer func() {
+    if err != nil {
+      for _, w := range writes {
+        w.cleanup()
+      }
+    }
+  }()
+
+  for _, d := range dests {
+    w, err := r.stageDestination(t, d, content)
+    if err != nil {
+      return nil, err
+    }
+    if w != nil {
+      writes = append(writes, w)
+    }
   }
 
-  if same {
-    log.Debugf("Destination %s is up to date", t.Dest)
-    return nil
+  if len(writes) == 0 {
+    r.Manifest.add(t, content)
+    return nil, nil
   }
 
-  log.Debug("Creating staging file")
-  stagingFile, err := createStagingFile(content, t.Dest)
-  if err != nil {
-    return err
+  // all destinations receive the same content, so it is only checked once
+  if !t.CheckCmd.IsEmpty() {
+    err := check(t, t.CheckCmd, writes[0].stagingFile)
+    r.record.command(stageCheck, t.CheckCmd.String(), err)
+    if err != nil {
+      return nil, stageErr(stageCheck, fmt.Errorf("Check command failed: %w", err))
+    }
   }
 
-  defer os.Remove(stagingFile)
+  if t.Check != "" {
+    command, err := runCheckProfile(t, content, r.Config.StagingDir)
+    r.record.command(stageCheck, command, err)
+    if err != nil {
+      return nil, stageErr(stageCheck, fmt.Errorf("Check profile %s failed: %w", t.Check, err))
+    }
+  }
 
-  if t.CheckCmd != "" {
-    if err := check(t.CheckCmd, stagingFile); err != nil {
-      return fmt.Errorf("Check command failed: %v", err)
+  for _, w := range writes {
+    if err := w.prepare(); err != nil {
+      return nil, stageErr(stageWrite, fmt.Errorf("Could not prepare destination %s: %v", w.dest.Path, err))
     }
   }
 
-  log.Debugf("Writing destination")
-  if err = copyStagingToDestination(stagingFile, t.Dest); err != nil {
-    return fmt.Errorf("Could not write destination file %s: %v", t.Dest, err)
+  return &stagedTemplate{content: content, writes: writes}, nil
+}
+
+// runNotify runs the notify command of the template, retrying failed runs
+// with exponential backoff. If the command still fails after all retries,
+// the notification is marked as pending and retried in later cycles even if
+// the destination doesn't change again.
+func (r *runner) runNotify(t Template, status *templateStatus, record *auditRecord) error {
+  if !t.hasNotify() {
+    return nil
+  }
+
+  backoff := time.Duration(t.NotifyBackoff) * time.Second
+  if backoff <= 0 {
+    backoff = time.Second
   }
 
-  log.Infof("Destination file %s has been updated", t.Dest)
+  var err error
+  for attempt := 0; ; attempt++ {
+    r.summary.notified()
+    if err = notifyTargets(t, record); err == nil || attempt >= t.NotifyRetries {
+      break
+    }
+
+    log.Warnf("Notify command for %s failed: %v. Retrying in %s (%d/%d)", t.Source, err, backoff, attempt+1, t.NotifyRetries)
+    r.Status.update(func() {
+      status.NotifyRetries++
+    })
+    time.Sleep(backoff)
+
+    if backoff *= 2; backoff > maxNotifyBackoff {
+      backoff = maxNotifyBackoff
+    }
+  }
+
+  r.Status.update(func() {
+    if err != nil {
+      status.NotifyFailures++
+      status.NotifyPending = true
+    } else {
+      status.NotifyFailures = 0
+      status.NotifyPending = false
+    }
+  })
+
+  return err
+}
+
+// notifyTargets runs the notify command and reloads the systemd unit
+// configured for the template.
+func notifyTargets(t Template, record *auditRecord) error {
+  if !t.NotifyCmd.IsEmpty() {
+    err := notify(t, t.NotifyCmd, t.NotifyOutput)
+    record.command(stageNotify, t.NotifyCmd.String(), err)
+    if err != nil {
+      return err
+    }
+  }
 
-  if t.NotifyCmd != "" {
-    if err := notify(t.NotifyCmd, t.NotifyOutput); err != nil {
-      return fmt.Errorf("Notify command failed: %v", err)
+  if t.ReloadUnit != "" {
+    err := reloadUnit(t.ReloadUnit)
+    record.command(stageNotify, "reload-unit "+t.ReloadUnit, err)
+    if err != nil {
+      return err
     }
   }
 
   return nil
 }
 
-func copyStagingToDestination(stagingPath, destPath string) error {
+// retryNotify retries the pending notify commands of all templates. It is
+// called when the metadata version didn't change, so failed notifications
+// don't have to wait for the next metadata update.
+func (r *runner) retryNotify() {
+  jobs := make([]*notifyJob, 0)
+  for _, i := range r.Status.pendingNotify() {
+    tmpl := r.Config.Templates[i]
+    log.Infof("Retrying pending notify command for %s", tmpl.Source)
+    jobs = append(jobs, newNotifyJob(i, tmpl, r.Status.Templates[i], r.Audit.newRecord(r.Status.Version, tmpl)))
+  }
+
+  r.runNotifyJobs(jobs)
+  for _, job := range jobs {
+    if job.err != nil {
+      r.notifyFailed(job, r.Status.Version)
+    }
+    r.Audit.write(job.record)
+  }
+}
+
+// contextHash returns a checksum of the serialized context and the other
+// inputs of a render, e.g. the versions of the template sources, so edited
+// templates are rendered even if the context is unchanged.
+func contextHash(ctx *TemplateContext, inputs ...string) (string, error) {
+  buf, err := json.Marshal(ctx.Export())
+  if err != nil {
+    return "", err
+  }
+
+  h := md5.New()
+  h.Write(buf)
+  for _, in := range inputs {
+    io.WriteString(h, in)
+  }
+  return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// cycleHash returns the checksum of the inputs of a cycle: the context, the
+// configuration and the versions of the template sources and the template
+// library.
+func (r *runner) cycleHash(ctx *TemplateContext) (string, error) {
+  conf, err := json.Marshal(r.Config)
+  if err != nil {
+    return "", err
+  }
+
+  inputs := []string{string(conf)}
+  for _, t := range r.Config.Templates {
+    inputs = append(inputs, r.sourceVersion(t))
+  }
+  return contextHash(ctx, inputs...)
+}
+
+// copyStagingToDestination replaces the destination with the staging
+// file, which is in the same directory. Destinations that are mount
+// points, e.g. single files bind mounted into the container, can't be
+// replaced and fail unless bind-mount-writes is 'in-place'.
+func copyStagingToDestination(stagingPath, destPath, mountWrites string) error {
   err := os.Rename(stagingPath, destPath)
   if err == nil {
     return nil
   }
 
-  if !strings.Contains(err.Error(), "device or resource busy") {
+  if !isCrossDeviceError(err) {
     return err
   }
 
-  // A 'device busy' error could mean that the files live in
-  // different mounts. Try to read the staging file and write
-  // it's content to the destination file.
   log.Debugf("Failed to rename staging file: %v", err)
+  if mountWrites != mountWritesInPlace {
+    return fmt.Errorf("%s is a mount point and can't be replaced atomically. Mount its directory instead", destPath)
+  }
+  log.Warnf("Destination %s is a mount point, overwriting it in place", destPath)
 
-  content, err := ioutil.ReadFile(stagingPath)
+  sfi, err := os.Stat(stagingPath)
   if err != nil {
     return err
   }
 
-  sfi, err := os.Stat(stagingPath)
+  content, err := ioutil.ReadFile(stagingPath)
   if err != nil {
     return err
   }
 
-  if err := ioutil.WriteFile(destPath, content, sfi.Mode()); err != nil {
+  if err := writeSynced(destPath, content); err != nil {
     return err
   }
 
-  if os_stat, ok := sfi.Sys().(*syscall.Stat_t); ok {
-    if err := os.Chown(destPath, int(os_stat.Uid), int(os_stat.Gid)); err != nil {
-      return err
-    }
+  if err := os.Chmod(destPath, sfi.Mode()); err != nil {
+    return err
   }
 
-  return nil
+  if err := copyOwnership(destPath, sfi); err != nil {
+    return err
+  }
+
+  return copyXattrs(stagingPath, destPath)
 }
 
-func (r *runner) createContext() (*TemplateContext, error) {
+// createContext builds the context of the global context version from the
+// local metadata service and the additional environments. References that
+// can't be resolved, which happens while stacks are upgraded, are listed in
+// the returned report instead of failing the whole context.
+func (r *runner) createContext() (*TemplateContext, *consistencyReport, error) {
+  meta, err := fetchMetadata(r.Client, true)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  version := r.contextVersion(Template{})
+  ctx, report := r.buildContext(meta, version)
+  if len(r.Environments) > 0 {
+    ctx.Environments = r.environmentContexts(report, version)
+  }
+
+  return ctx, report, nil
+}
+
+// metadataSnapshot is the metadata a context is built from. It is kept with
+// the context, so contexts of other context versions can be built from the
+// same metadata.
+type metadataSnapshot struct {
+  stacks     []metadata.Stack
+  services   []metadata.Service
+  containers []metadata.Container
+  hosts      []metadata.Host
+  // the container of rancher-conf, nil for additional environments
+  self       *metadata.Container
+}
+
+// fetchMetadata reads the metadata served by client. Self is only looked up
+// if withSelf is set, i.e. for the local metadata service.
+func fetchMetadata(client metadata.Client, withSelf bool) (*metadataSnapshot, error) {
   log.Debug("Fetching Metadata")
 
-  metaStacks, err := r.Client.GetStacks()
-  if err != nil {
+  var err error
+  meta := &metadataSnapshot{}
+  if meta.stacks, err = client.GetStacks(); err != nil {
     return nil, err
   }
-  metaServices, err := r.Client.GetServices()
-  if err != nil {
+  if meta.services, err = client.GetServices(); err != nil {
     return nil, err
   }
-  metaContainers, err := r.Client.GetContainers()
-  if err != nil {
+  if meta.containers, err = client.GetContainers(); err != nil {
     return nil, err
   }
-  metaHosts, err := r.Client.GetHosts()
-  if err != nil {
+  if meta.hosts, err = client.GetHosts(); err != nil {
     return nil, err
   }
-  metaSelf, err := r.Client.GetSelfContainer()
-  if err != nil {
-    return nil, err
+  if withSelf {
+    self, err := client.GetSelfContainer()
+    if err != nil {
+      return nil, err
+    }
+    meta.self = &self
+  }
+  return meta, nil
+}
+
+// buildContext builds the context of the given context version from the
+// metadata.
+func (r *runner) buildContext(meta *metadataSnapshot, version int) (*TemplateContext, *consistencyReport) {
+  metaStacks, metaServices, metaContainers, metaHosts := meta.stacks, meta.services, meta.containers, meta.hosts
+  withSelf := meta.self != nil
+  metaSelf := metadata.Container{}
+  if withSelf {
+    metaSelf = *meta.self
   }
 
+  report := &consistencyReport{}
+
   log.Debugf("metaSelf %+v", metaSelf)
 
   self := Self{}
@@ -237,9 +964,7 @@ func (r *runner) createContext() (*TemplateContext, error) {
     stackMap[s.Name] = &stack
   }
 
-  sort.SliceStable(stacks, func(i, j int) bool {
-    return stacks[i].UUID < stacks[j].UUID
-  })
+  sortStacks(stacks)
 
   hosts := make([]*Host, 0)
   hostMap := make(map[string]*Host)
@@ -254,14 +979,22 @@ func (r *runner) createContext() (*TemplateContext, error) {
     hostMap[host.UUID] = &host
   }
 
-  sort.SliceStable(hosts, func(i, j int) bool {
-    return hosts[i].UUID < hosts[j].UUID
-  })
+  sortHosts(hosts)
 
   services := make([]*Service, 0)
   serviceMap := make(map[string]*Service)
   sidekickParent := make(map[string]*Service)
   for _, s := range metaServices {
+    // Services of a stack that is missing from the metadata get a
+    // placeholder stack, which isn't listed in the context's stacks.
+    if _, ok := stackMap[s.StackName]; !ok {
+      report.add("stack %s of service %s not found", s.StackName, s.Name)
+      placeholder := Stack{
+        Stack:    metadata.Stack{Name: s.StackName, UUID: s.StackUUID},
+        Services: make([]*Service, 0),
+      }
+      stackMap[s.StackName] = &placeholder
+    }
     s.StackUUID = stackMap[s.StackName].UUID
 
     stackServiceName := s.StackName + "." + s.Name
@@ -269,10 +1002,14 @@ func (r *runner) createContext() (*TemplateContext, error) {
       Service:    s,
       Sidekicks:  make([]*Service, 0),
       Containers: make([]*Container, 0),
-      Ports:      parseServicePorts(s.Ports),
+      Ports:      parseServicePorts(s.Ports, version),
       Labels:     LabelMap(sortedLabelMap(s.Labels)),
       Links:      LabelMap(sortedLabelMap(s.Links)),
+      linked:     make(map[string]*Service),
+      version:    version,
       Metadata:   MetadataMap(sortedMetaMap(s.Metadata)),
+      Fqdn:       serviceFqdn(s.Name, s.StackName),
+      ExternalFqdn: s.Fqdn,
       Stack:      stackMap[s.StackName],
       Primary:    s.Name == s.PrimaryServiceName,
       Sidekick:   s.Name != s.PrimaryServiceName,
@@ -289,45 +1026,61 @@ func (r *runner) createContext() (*TemplateContext, error) {
       }
     }
 
-    if s.StackName == metaSelf.StackName && s.Name == metaSelf.ServiceName {
+    if withSelf && s.StackName == metaSelf.StackName && s.Name == metaSelf.ServiceName {
       log.Debugf("Setting Self.Service to %s", s.Name)
       self.Service = &service
     }
   }
 
   for sk, service := range sidekickParent {
+    if serviceMap[sk] == nil {
+      report.add("sidekick %s of service %s not found", sk, service.Name)
+      continue
+    }
     service.Sidekicks = append(service.Sidekicks, serviceMap[sk])
     serviceMap[sk].Parent = service
     log.Debugf("Setting parent of %s to %s", serviceMap[sk].Name, service.Name)
   }
 
-  sort.SliceStable(services, func(i, j int) bool {
-    if services[i].UUID == services[j].UUID {
-      return services[i].Name < services[j].Name
-    } else {
-      return services[i].UUID < services[j].UUID
+  for _, service := range services {
+    for ref, alias := range service.Links {
+      name, stack := parseServiceRef(ref, service.Stack.Name)
+      linked, ok := serviceMap[stack + "." + name]
+      if !ok {
+        log.Debugf("Linked service %s of service %s not found", ref, service.Name)
+        continue
+      }
+      if alias == "" {
+        alias = name
+      }
+      service.linked[alias] = linked
     }
-  })
+  }
 
+  sortServices(services)
   for _, service := range services {
-    sort.SliceStable(service.Sidekicks, func(i, j int) bool {
-      return service.Sidekicks[i].UUID < service.Sidekicks[j].UUID
-    })
-
-    sort.SliceStable(service.Stack.Services, func(i, j int) bool {
-      return service.Stack.Services[i].UUID < service.Stack.Services[j].UUID
-    })
+    sortServices(service.Sidekicks)
+  }
+  for _, stack := range stackMap {
+    sortServices(stack.Services)
   }
 
   containers := make([]*Container, 0)
   deploymentParent := make(map[string]*Container)
   for _, c := range metaContainers {
+    if !r.Config.IncludeInactive && !isActiveState(c.State) {
+      log.Debugf("Skipping container %s in state %s", c.Name, c.State)
+      continue
+    }
+
     stackServiceName := c.StackName + "." + c.ServiceName
     container := Container{
       Container:  c,
-      Ports:      parseServicePorts(c.Ports),
+      Ports:      parseServicePorts(c.Ports, version),
       Labels:     LabelMap(sortedLabelMap(c.Labels)),
       Links:      LabelMap(sortedLabelMap(c.Links)),
+      Fqdn:       containerFqdn(c.Name),
+      version:    version,
       Primary:    c.Labels["io.rancher.service.launch.config"] == "io.rancher.service.primary.launch.config",
       Sidekick:   c.Labels["io.rancher.service.launch.config"] != "io.rancher.service.primary.launch.config",
       Service:    serviceMap[stackServiceName],
@@ -335,38 +1088,43 @@ func (r *runner) createContext() (*TemplateContext, error) {
       Sidekicks:  make([]*Container, 0),
     }
 
+    if container.Service == nil && c.ServiceName != "" {
+      report.add("service %s of container %s not found", stackServiceName, c.Name)
+    }
+    if container.Host == nil {
+      report.add("host %s of container %s not found", c.HostUUID, c.Name)
+    }
+
     if container.Primary {
       deployment := container.Labels.GetValue("io.rancher.service.deployment.unit")
       deploymentParent[deployment] = &container
     }
 
-    if (c.UUID == metaSelf.UUID && r.Config.SelfId == "") || (c.UUID == r.Config.SelfId) {
+    if withSelf && ((c.UUID == metaSelf.UUID && r.Config.SelfId == "") || (c.UUID == r.Config.SelfId)) {
       log.Debugf("Setting Self.Container to %s", c.UUID)
       self.Container = &container
       self.Service = container.Service
-      self.Stack = container.Service.Stack
       self.Host = container.Host
+      if container.Service != nil {
+        self.Stack = container.Service.Stack
+      }
     }
 
     containers = append(containers, &container)
   }
 
-  sort.SliceStable(containers, func(i, j int) bool {
-    if (containers[i].CreateIndex != containers[j].CreateIndex) {
-      return containers[i].CreateIndex < containers[j].CreateIndex
-    } else if (containers[i].UUID != containers[j].UUID) {
-      return containers[i].UUID < containers[j].UUID
-    } else {
-      return containers[i].Name < containers[j].Name
-    }
-  })
+  // The containers of services and hosts and the sidekicks of containers
+  // are appended in this order, so they don't need to be sorted again.
+  sortContainers(containers)
 
   for _, container := range containers {
     deployment := container.Labels.GetValue("io.rancher.service.deployment.unit")
     parent, hasParent := deploymentParent[deployment]
     if container.Sidekick && hasParent {
       container.Parent = parent
-      container.Service.Parent = parent.Service
+      if container.Service != nil {
+        container.Service.Parent = parent.Service
+      }
       parent.Sidekicks = append(parent.Sidekicks, container)
     }
 
@@ -387,38 +1145,53 @@ func (r *runner) createContext() (*TemplateContext, error) {
     Containers: containers,
     Stacks:     stacks,
     Self:       self,
+    MetadataVersion: r.Config.MetadataVersion,
+    version:    version,
+    snapshot:   meta,
   }
 
-  for _, container := range ctx.Self.Service.Containers {
-    log.Debugf("Self Service Container %s", container.Name)
+  if !withSelf {
+    return &ctx, report
   }
 
-  return &ctx, nil
+  if ctx.Self.Container == nil {
+    selfId := metaSelf.UUID
+    if r.Config.SelfId != "" {
+      selfId = r.Config.SelfId
+    }
+    report.add("self container %s not found", selfId)
+  } else if ctx.Self.Service != nil {
+    for _, container := range ctx.Self.Service.Containers {
+      log.Debugf("Self Service Container %s", container.Name)
+    }
+  }
+
+  return &ctx, report
 }
 
 // converts Metadata.Service.Ports string slice to a ServicePort slice
-func parseServicePorts(ports []string) []ServicePort {
+func parseServicePorts(ports []string, version int) []ServicePort {
   var ret []ServicePort
   for _, port := range ports {
     parts := strings.Split(port, ":")
     if len(parts) == 2 {
-      public := parts[0]
       if parts_ := strings.Split(parts[1], "/"); len(parts_) == 2 {
         ret = append(ret, ServicePort{
-          PublicPort:   public,
+          PublicPort:   parts[0],
           InternalPort: parts_[0],
           Protocol:     parts_[1],
+          version:      version,
         })
         continue
       }
     } else if len(parts) == 3 {
-      public := parts[1]
       if parts_ := strings.Split(parts[2], "/"); len(parts_) == 2 {
         ret = append(ret, ServicePort{
           BindAddress:  parts[0],
-          PublicPort:   public,
+          PublicPort:   parts[1],
           InternalPort: parts_[0],
           Protocol:     parts_[1],
+          version:      version,
         })
         continue
       }
@@ -429,50 +1202,149 @@ func parseServicePorts(ports []string) []ServicePort {
   return ret
 }
 
-func post(command string) error {
+// portNumber returns the number of a port, or 0 if it is not a number.
+func portNumber(port string) int {
+  n, _ := strconv.Atoi(port)
+  return n
+}
+
+func post(t Template, command Command) error {
   log.Infof("Executing post-version cmd '%s'", command)
-  cmd := exec.Command("/bin/sh", "-c", command)
-  out, err := cmd.CombinedOutput()
+  cmd, err := newCommand(t, command)
   if err != nil {
-    logCmdOutput(command, out)
     return err
   }
 
+  out, err := childCombinedOutput(cmd)
+  if err != nil {
+    logCmdOutput(command.String(), out)
+    return &commandError{Err: err, Output: out}
+  }
+
   log.Debugf("Version cmd output: %q", string(out))
   return nil
 }
 
-func check(command, filePath string) error {
-  command = strings.Replace(command, "{{staging}}", filePath, -1)
+func check(t Template, command Command, filePath string) error {
+  command = command.Replace("{{staging}}", filePath)
   log.Debugf("Running check command '%s'", command)
-  cmd := exec.Command("/bin/sh", "-c", command)
-  out, err := cmd.CombinedOutput()
+  cmd, err := newCommand(t, command)
   if err != nil {
-    logCmdOutput(command, out)
     return err
   }
 
+  out, err := childCombinedOutput(cmd)
+  if err != nil {
+    logCmdOutput(command.String(), out)
+    return &commandError{Err: err, Output: out}
+  }
+
   log.Debugf("Check cmd output: %q", string(out))
   return nil
 }
 
-func notify(command string, verbose bool) error {
+// postProcess pipes the content through the command and returns its
+// output. Only the standard output of the command is used, the standard
+// error is logged if the command fails.
+func postProcess(t Template, command Command, content []byte) ([]byte, error) {
+  log.Debugf("Running post-process command '%s'", command)
+  cmd, err := newCommand(t, command)
+  if err != nil {
+    return nil, err
+  }
+
+  var stderr bytes.Buffer
+  cmd.Stdin = bytes.NewReader(content)
+  cmd.Stderr = &stderr
+
+  out, err := childOutput(cmd)
+  if err != nil {
+    logCmdOutput(command.String(), stderr.Bytes())
+    return nil, &commandError{Err: err, Output: stderr.Bytes()}
+  }
+
+  return out, nil
+}
+
+func notify(t Template, command Command, verbose bool) error {
   log.Infof("Executing notify command '%s'", command)
-  cmd := exec.Command("/bin/sh", "-c", command)
-  out, err := cmd.CombinedOutput()
+  cmd, err := newCommand(t, command)
   if err != nil {
-    logCmdOutput(command, out)
     return err
   }
 
+  out, err := childCombinedOutput(cmd)
+  if err != nil {
+    logCmdOutput(command.String(), out)
+    return &commandError{Err: err, Output: out}
+  }
+
   if verbose {
-    logCmdOutput(command, out)
+    logCmdOutput(command.String(), out)
   }
 
   log.Debugf("Notify cmd output: %q", string(out))
   return nil
 }
 
+// shellCommand returns a command that runs the given command line in the
+// shell, falling back to the platform's default shell.
+func shellCommand(shell []string, command string) *exec.Cmd {
+  if len(shell) == 0 {
+    shell = shellArgs
+  }
+  args := append(append([]string{}, shell[1:]...), command)
+  return exec.Command(shell[0], args...)
+}
+
+// newCommand returns the command to execute for the given template command
+// that runs with the user, group and environment configured for the
+// template. Argument vectors are executed directly, command lines are run in
+// the template's shell.
+func newCommand(t Template, command Command) (*exec.Cmd, error) {
+  var cmd *exec.Cmd
+  if len(command.Argv) > 0 {
+    cmd = exec.Command(command.Argv[0], command.Argv[1:]...)
+  } else {
+    cmd = shellCommand(t.Shell.Fields(), command.Line)
+  }
+
+  if t.CommandEnv != nil {
+    cmd.Env = filterEnv(os.Environ(), t.CommandEnv)
+  }
+
+  if t.CommandUser != "" || t.CommandGroup != "" {
+    if err := setCommandCredentials(cmd, t.CommandUser, t.CommandGroup); err != nil {
+      return nil, fmt.Errorf("Could not run command as %s:%s: %v", t.CommandUser, t.CommandGroup, err)
+    }
+  }
+
+  return cmd, nil
+}
+
+// filterEnv returns the variables of env whose names are part of the
+// allowlist. Allowlist entries in the form NAME=VALUE are added as is.
+func filterEnv(env []string, allowlist []string) []string {
+  allowed := make(map[string]bool)
+  filtered := make([]string, 0)
+  for _, item := range allowlist {
+    if strings.Contains(item, "=") {
+      filtered = append(filtered, item)
+    } else {
+      allowed[item] = true
+    }
+  }
+
+  for _, kv := range env {
+    name := strings.SplitN(kv, "=", 2)[0]
+    if allowed[name] {
+      filtered = append(filtered, kv)
+    }
+  }
+
+  return filtered
+}
+
 func logCmdOutput(command string, output []byte) {
   for _, line := range strings.Split(string(output), "\n") {
     if line != "" {
@@ -521,17 +1393,93 @@ func computeFileMd5(filePath string) (string, error) {
   return fmt.Sprintf("%x", hash.Sum(nil)), nil
 }
 
-func createStagingFile(content []byte, destFile string) (string, error) {
-  fp, err := ioutil.TempFile(filepath.Dir(destFile), "."+filepath.Base(destFile)+"-")
+// isCrossDeviceError returns true if err indicates that a file could not be
+// renamed because source and destination live on different mounts.
+func isCrossDeviceError(err error) bool {
+  if lerr, ok := err.(*os.LinkError); ok {
+    return lerr.Err == syscall.EXDEV || lerr.Err == syscall.EBUSY
+  }
+  return strings.Contains(err.Error(), "device or resource busy")
+}
+
+// stagingPattern returns the glob pattern matching staging files of destFile.
+func stagingPattern(destFile, stagingDir string) string {
+  if stagingDir == "" {
+    stagingDir = filepath.Dir(destFile)
+  }
+  return filepath.Join(stagingDir, "."+filepath.Base(destFile)+"-*")
+}
+
+// cleanupStagingFiles removes staging files left behind by previous runs
+// that were interrupted before the files could be promoted.
+func cleanupStagingFiles(templates []Template, stagingDir string) {
+  for _, t := range templates {
+    for _, d := range t.destinations() {
+      if !isRemoteDestination(d.Path) {
+        cleanupStagingFilesOf(d.Path, stagingDir)
+        continue
+      }
+
+      // staging files of remote destinations are named after the remote
+      // content and created in the staging or temporary directory
+      remote, err := newRemoteDestination(d.Path)
+      if err != nil {
+        continue
+      }
+      dir := stagingDir
+      if dir == "" {
+        dir = os.TempDir()
+      }
+      cleanupStagingFilesOf(filepath.Join(dir, remote.Name()), "")
+    }
+  }
+  cleanupCheckDirs(stagingDir)
+}
+
+// cleanupStagingFilesOf removes orphaned staging files of a destination.
+func cleanupStagingFilesOf(dest, stagingDir string) {
+  if isRemoteDestination(dest) {
+    return
+  }
+
+  pattern := stagingPattern(dest, stagingDir)
+  matches, err := filepath.Glob(pattern)
+  if err != nil {
+    log.Warnf("Could not search for orphaned staging files %s: %v", pattern, err)
+    return
+  }
+
+  prefix := strings.TrimSuffix(filepath.Base(pattern), "*")
+  for _, match := range matches {
+    // staging files are suffixed with a random number
+    suffix := strings.TrimPrefix(filepath.Base(match), prefix)
+    if _, err := strconv.ParseUint(suffix, 10, 64); err != nil {
+      continue
+    }
+
+    log.Infof("Removing orphaned staging file %s", match)
+    if err := os.Remove(match); err != nil {
+      log.Warnf("Could not remove orphaned staging file %s: %v", match, err)
+    }
+  }
+}
+
+func createStagingFile(content []byte, destFile, stagingDir string) (string, error) {
+  if stagingDir == "" {
+    stagingDir = filepath.Dir(destFile)
+  }
+
+  fp, err := ioutil.TempFile(stagingDir, "."+filepath.Base(destFile)+"-")
   if err != nil {
     return "", fmt.Errorf("Could not create staging file for %s: %v", destFile, err)
   }
+  trackTemp(fp.Name())
 
   log.Debugf("Created staging file %s", fp.Name())
 
   onErr := func() {
     fp.Close()
-    os.Remove(fp.Name())
+    removeTemp(fp.Name())
   }
 
   if _, err := fp.Write(content); err != nil {
@@ -545,11 +1493,13 @@ func createStagingFile(content []byte, destFile string) (string, error) {
       onErr()
       return "", fmt.Errorf("Failed to copy permissions from %s: %v", destFile, err)
     }
-    if os_stat, ok := stat.Sys().(*syscall.Stat_t); ok {
-      if err := fp.Chown(int(os_stat.Uid), int(os_stat.Gid)); err != nil {
-        onErr()
-        return "", fmt.Errorf("Failed to copy ownership: %v", err)
-      }
+    if err := copyOwnership(fp.Name(), stat); err != nil {
+      onErr()
+      return "", fmt.Errorf("Failed to copy ownership: %v", err)
+    }
+    if err := copyXattrs(destFile, fp.Name()); err != nil {
+      onErr()
+      return "", fmt.Errorf("Failed to copy extended attributes from %s: %v", destFile, err)
     }
   }
 
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RunnerInfo describes the rancher-conf instance and the cycle rendering a
+// template, e.g. for provenance headers in generated files. It is exposed
+// as .Runner and not part of the context checksum, so it doesn't cause
+// templates to be rendered again.
+type RunnerInfo struct {
+	// version of rancher-conf
+	Version string `json:"version"`
+	GitSHA  string `json:"git_sha"`
+	// hostname of the rancher-conf container
+	Hostname string `json:"hostname"`
+	// metadata version being rendered
+	MetadataVersion string `json:"metadata_version"`
+	// time the cycle started rendering templates
+	Generated time.Time `json:"generated"`
+}
+
+// newRunnerInfo returns the runner information for a cycle rendering the
+// given metadata version. In onetime mode the version is read from the
+// metadata service.
+func (r *runner) newRunnerInfo(version string) RunnerInfo {
+	if version == "init" && r.Client != nil {
+		if v, err := r.Client.GetVersion(); err == nil {
+			// the version is returned as JSON string
+			if unquoted, err := strconv.Unquote(v); err == nil {
+				v = unquoted
+			}
+			version = v
+		} else {
+			log.Debugf("Could not read metadata version: %v", err)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	return RunnerInfo{
+		Version:         Version,
+		GitSHA:          GitSHA,
+		Hostname:        hostname,
+		MetadataVersion: version,
+		Generated:       time.Now().UTC(),
+	}
+}
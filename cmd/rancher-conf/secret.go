@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultSecretsDir is the directory Docker and Rancher mount secrets to.
+const defaultSecretsDir = "/run/secrets"
+
+// secretStore reads secret files for templates and remembers their
+// checksums, so that rotated secrets trigger a render.
+type secretStore struct {
+	dir string
+
+	mu sync.Mutex
+	// checksums of the files read by templates, by path
+	files map[string]string
+}
+
+func newSecretStore(dir string) *secretStore {
+	if dir == "" {
+		dir = defaultSecretsDir
+	}
+	return &secretStore{dir: dir, files: make(map[string]string)}
+}
+
+// read returns the content of the secret file with the given name in the
+// secrets directory. The options 'trim' removes leading and trailing
+// whitespace and 'base64' decodes base64 encoded content. The content is
+// masked in logs.
+func (s *secretStore) read(name string, options ...string) (string, error) {
+	path := filepath.Join(s.dir, filepath.FromSlash(name))
+	if rel, err := filepath.Rel(s.dir, path); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("(secretFile) invalid secret name '%s'", name)
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("(secretFile) %v", err)
+	}
+
+	s.mu.Lock()
+	s.files[path] = fmt.Sprintf("%x", md5.Sum(buf))
+	s.mu.Unlock()
+
+	value := string(buf)
+	secrets.addValue(value)
+	for _, option := range options {
+		switch option {
+		case "trim":
+			value = strings.TrimSpace(value)
+		case "base64":
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+			if err != nil {
+				return "", fmt.Errorf("(secretFile) could not decode %s: %v", name, err)
+			}
+			value = string(decoded)
+		default:
+			return "", fmt.Errorf("(secretFile) unknown option '%s'", option)
+		}
+	}
+
+	secrets.addValue(value)
+	return value, nil
+}
+
+// changed returns the secret files whose content changed since they were
+// last read. Their new checksums are remembered, so every change is only
+// reported once.
+func (s *secretStore) changed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := make([]string, 0)
+	for path, sum := range s.files {
+		current := ""
+		if buf, err := ioutil.ReadFile(path); err == nil {
+			current = fmt.Sprintf("%x", md5.Sum(buf))
+		}
+		if current != sum {
+			s.files[path] = current
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
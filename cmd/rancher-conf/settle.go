@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+	log "github.com/sirupsen/logrus"
+)
+
+// waitSettled delays the first render after startup until the metadata
+// version did not change for startup-settle seconds or all
+// expected-services are present, whichever comes first. If only
+// expected-services is set, it waits until they are present. maxWait limits
+// the duration of a single metadata request.
+func (r *runner) waitSettled(maxWait int, watchdog bool) error {
+	settle := time.Duration(r.Config.StartupSettle) * time.Second
+	expected := r.Config.ExpectedServices
+	if settle <= 0 && len(expected) == 0 {
+		return nil
+	}
+
+	log.Infof("Waiting for metadata to settle before the first render")
+	version, err := r.Client.GetVersion()
+	if err != nil {
+		return err
+	}
+
+	stableSince := time.Now()
+	lastLog := time.Now()
+	for {
+		if len(expected) > 0 {
+			missing, err := r.missingServices(expected)
+			if err != nil {
+				return err
+			}
+			if len(missing) == 0 {
+				log.Infof("All expected services are present")
+				return nil
+			}
+			if time.Since(lastLog) >= time.Minute {
+				log.Infof("Waiting for expected services: %s", strings.Join(missing, ", "))
+				lastLog = time.Now()
+			}
+		}
+
+		wait := maxWait
+		if settle > 0 {
+			remaining := settle - time.Since(stableSince)
+			if remaining <= 0 {
+				log.Infof("Metadata version %s has been stable for %s", version, settle)
+				return nil
+			}
+			if s := int((remaining + time.Second - 1) / time.Second); s < wait {
+				wait = s
+			}
+		}
+
+		if watchdog {
+			sdNotify(daemon.SdNotifyWatchdog)
+		}
+		newVersion, err := r.waitVersion(version, wait)
+		if err != nil {
+			return err
+		}
+		if newVersion != version {
+			log.Debugf("Metadata version changed to %s while settling", newVersion)
+			version = newVersion
+			stableSince = time.Now()
+		}
+	}
+}
+
+// missingServices returns the expected services that are not present in
+// the metadata. Services are identified as 'stack-name/service-name' or
+// 'service-name[.stack-name]', see parseServiceRef; services without stack
+// name may be part of any stack.
+func (r *runner) missingServices(expected []string) ([]string, error) {
+	services, err := r.Client.GetServices()
+	if err != nil {
+		return nil, err
+	}
+
+	missing := make([]string, 0)
+	for _, identifier := range expected {
+		name, stack := parseServiceRef(identifier, "")
+
+		found := false
+		for _, s := range services {
+			if strings.EqualFold(s.Name, name) && (stack == "" || strings.EqualFold(s.StackName, stack)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, identifier)
+		}
+	}
+	return missing, nil
+}
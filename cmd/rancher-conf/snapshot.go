@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// snapshotPrefix is the prefix of the names of snapshot files.
+	snapshotPrefix = "context-"
+	// defaultSnapshotKeep is the number of snapshots kept if snapshot-keep
+	// is not set.
+	defaultSnapshotKeep = 10
+)
+
+// unsafeFileChars matches characters replaced in the version part of
+// snapshot file names.
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// contextSnapshot is the content of a snapshot file.
+type contextSnapshot struct {
+	Time    time.Time   `json:"time"`
+	Version string      `json:"version"`
+	Context interface{} `json:"context"`
+}
+
+// writeSnapshot persists the context of a metadata version as gzip
+// compressed JSON in the snapshot directory and removes the oldest
+// snapshots beyond snapshot-keep. Failures are only logged, as snapshots
+// are a debugging aid.
+func (r *runner) writeSnapshot(version string, ctx *TemplateContext) {
+	dir := r.Config.SnapshotDir
+	if dir == "" {
+		return
+	}
+
+	now := time.Now().UTC()
+	buf, err := json.Marshal(contextSnapshot{Time: now, Version: version, Context: ctx.Export()})
+	if err != nil {
+		log.Warnf("Could not encode context snapshot: %v", err)
+		return
+	}
+	if buf, err = compressContent(buf, compressGzip); err != nil {
+		log.Warnf("Could not compress context snapshot: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Warnf("Could not create snapshot directory %s: %v", dir, err)
+		return
+	}
+
+	name := fmt.Sprintf("%s%s-%s.json.gz", snapshotPrefix, now.Format("20060102T150405.000Z"), unsafeFileChars.ReplaceAllString(version, "_"))
+	path := filepath.Join(dir, name)
+	// the metadata may contain secrets
+	if err := ioutil.WriteFile(path, buf, 0600); err != nil {
+		log.Warnf("Could not write context snapshot %s: %v", path, err)
+		return
+	}
+	log.Debugf("Wrote context snapshot %s", path)
+
+	keep := r.Config.SnapshotKeep
+	if keep <= 0 {
+		keep = defaultSnapshotKeep
+	}
+	pruneSnapshots(dir, keep)
+}
+
+// pruneSnapshots removes all but the newest keep snapshots in dir. The
+// names start with the time of the snapshot, so they sort chronologically.
+func pruneSnapshots(dir string, keep int) {
+	matches, err := filepath.Glob(filepath.Join(dir, snapshotPrefix+"*.json.gz"))
+	if err != nil || len(matches) <= keep {
+		return
+	}
+
+	sort.Strings(matches)
+	for _, match := range matches[:len(matches)-keep] {
+		if err := os.Remove(match); err != nil {
+			log.Warnf("Could not remove context snapshot %s: %v", match, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cycleSummary collects statistics of the processing of a metadata
+// version. It is logged at the end of each cycle and served by the admin
+// API. All methods are no-ops on nil summaries, e.g. for notify retries
+// outside of a cycle.
+type cycleSummary struct {
+	// notify commands run concurrently
+	mu sync.Mutex
+
+	Version  string    `json:"version"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration_seconds"`
+	// templates that have been rendered
+	Rendered int `json:"rendered"`
+	// templates whose destinations have been updated
+	Updated int `json:"updated"`
+	// templates that have not been rendered because their context did not
+	// change or required services are missing
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+	// bytes written to destinations
+	BytesWritten int `json:"bytes_written"`
+	// runs of notify commands and unit reloads, including retries
+	Notified int  `json:"notified"`
+	Deferred bool `json:"deferred"`
+}
+
+func newCycleSummary(version string) *cycleSummary {
+	return &cycleSummary{Version: version, Start: time.Now()}
+}
+
+func (s *cycleSummary) rendered() {
+	if s != nil {
+		s.Rendered++
+	}
+}
+
+func (s *cycleSummary) skipped(n int) {
+	if s != nil {
+		s.Skipped += n
+	}
+}
+
+func (s *cycleSummary) written(size int) {
+	if s != nil {
+		s.BytesWritten += size
+	}
+}
+
+func (s *cycleSummary) notified() {
+	if s != nil {
+		s.mu.Lock()
+		s.Notified++
+		s.mu.Unlock()
+	}
+}
+
+// finish completes the summary with the result of the cycle and logs it.
+func (s *cycleSummary) finish(result cycleResult, templates int) {
+	s.Duration = time.Since(s.Start).Seconds()
+	s.Updated = result.Updated
+	s.Failed = result.Failed
+	if result.Failed < 0 {
+		// the context could not be built
+		s.Failed = templates
+	}
+	s.Deferred = result.Deferred
+
+	log.WithFields(log.Fields{
+		"version":       s.Version,
+		"rendered":      s.Rendered,
+		"updated":       s.Updated,
+		"skipped":       s.Skipped,
+		"failed":        s.Failed,
+		"bytes_written": s.BytesWritten,
+		"notified":      s.Notified,
+		"deferred":      s.Deferred,
+		"duration":      time.Duration(s.Duration * float64(time.Second)).Round(time.Millisecond).String(),
+	}).Info("Cycle summary")
+}
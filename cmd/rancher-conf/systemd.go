@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+	"github.com/coreos/go-systemd/v22/dbus"
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadUnitTimeout limits the time to wait for a unit reload job.
+const reloadUnitTimeout = time.Minute
+
+// sdNotify sends a state notification to systemd. It does nothing unless
+// rancher-conf runs as a service with Type=notify.
+func sdNotify(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		log.Warnf("Could not notify systemd: %v", err)
+	}
+}
+
+// sdWatchdogInterval returns the interval in which systemd expects
+// watchdog pings, or 0 if the watchdog is disabled.
+func sdWatchdogInterval() time.Duration {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		log.Warnf("Invalid systemd watchdog configuration: %v", err)
+		return 0
+	}
+	return interval
+}
+
+// reloadUnit reloads a systemd unit over D-Bus, like `systemctl reload`, and
+// waits for the reload job to finish.
+func reloadUnit(unit string) error {
+	log.Infof("Reloading systemd unit %s", unit)
+
+	ctx, cancel := context.WithTimeout(context.Background(), reloadUnitTimeout)
+	defer cancel()
+
+	conn, err := dbus.NewSystemConnectionContext(ctx)
+	if err != nil {
+		return fmt.Errorf("Could not connect to systemd: %v", err)
+	}
+	defer conn.Close()
+
+	done := make(chan string, 1)
+	if _, err := conn.ReloadUnitContext(ctx, unit, "replace", done); err != nil {
+		return fmt.Errorf("Could not reload unit %s: %v", unit, err)
+	}
+
+	select {
+	case result := <-done:
+		if result != "done" {
+			return fmt.Errorf("Reload of unit %s finished with result '%s'", unit, result)
+		}
+	case <-ctx.Done():
+		return fmt.Errorf("Reload of unit %s timed out", unit)
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// templateCache keeps the content of template files and their compiled
+// text/template form between cycles, so templates are only read and parsed
+// again when they change on disk.
+type templateCache struct {
+	entries map[string]*cachedTemplate
+}
+
+type cachedTemplate struct {
+	modTime time.Time
+	size    int64
+	source  []byte
+	// compiled is the parsed text/template. It is nil until the template
+	// is rendered with the go engine for the first time.
+	compiled *template.Template
+	// libVersion identifies the template library the template has been
+	// compiled with.
+	libVersion string
+}
+
+// templateLib is the set of files of the template library directory, which
+// are parsed into the namespace of every go template.
+type templateLib struct {
+	names   []string
+	entries []*cachedTemplate
+	// version changes whenever a file of the library is added, removed or
+	// modified
+	version string
+}
+
+func newTemplateCache() *templateCache {
+	return &templateCache{entries: make(map[string]*cachedTemplate)}
+}
+
+// Load returns the cache entry for the template at path. The entry is
+// replaced if the size or modification time of the file changed since it
+// was cached.
+func (c *templateCache) Load(path string) (*cachedTemplate, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, ok := c.entries[path]
+	if ok && entry.size == fi.Size() && entry.modTime.Equal(fi.ModTime()) {
+		return entry, nil
+	}
+
+	if ok {
+		log.Debugf("Template %s changed on disk, invalidating cache", path)
+	}
+
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entry = &cachedTemplate{
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		source:  source,
+	}
+	c.entries[path] = entry
+
+	return entry, nil
+}
+
+// LoadLib returns the files of the template library directory. Hidden files
+// and subdirectories are ignored.
+func (c *templateCache) LoadLib(dir string) (*templateLib, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	lib := &templateLib{}
+	var version strings.Builder
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		entry, err := c.Load(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		lib.names = append(lib.names, fi.Name())
+		lib.entries = append(lib.entries, entry)
+		fmt.Fprintf(&version, "%s:%d:%d;", fi.Name(), entry.size, entry.modTime.UnixNano())
+	}
+	lib.version = version.String()
+
+	return lib, nil
+}
+
+// sourceVersion identifies the content of the source of a template and of
+// the template library. It changes whenever one of the files is edited, so
+// checksums of the inputs of templates include it. Files that can't be read
+// are left out, they fail when the template is rendered.
+func (r *runner) sourceVersion(t Template) string {
+	var version strings.Builder
+	if entry, err := r.Cache.Load(t.Source); err == nil {
+		fmt.Fprintf(&version, "%s:%d:%d;", t.Source, entry.size, entry.modTime.UnixNano())
+	}
+	if engine, _ := templateEngine(t); engine == engineGo && r.Config.TemplateLibDir != "" {
+		if lib, err := r.Cache.LoadLib(r.Config.TemplateLibDir); err == nil {
+			version.WriteString(lib.version)
+		}
+	}
+	return version.String()
+}
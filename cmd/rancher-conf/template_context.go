@@ -20,6 +20,45 @@ type TemplateContext struct {
 	Hosts      []*Host
 	Stacks 		 []*Stack
 	Self       Self
+	Derived    map[string]interface{}
+	// version of the metadata API the context has been read from
+	MetadataVersion string
+	// additional Rancher environments by name
+	Environments map[string]*Environment
+
+	// context version the context has been built for and the metadata it
+	// has been built from, see contextForVersion
+	version  int
+	snapshot *metadataSnapshot
+	// contexts built for other context versions
+	versions map[int]*TemplateContext
+	// keep sets of the context script
+	filter map[string]map[string]bool
+}
+
+// The objects referenced by Self may be missing while the stack of the
+// container is upgraded, so lookups of the defaults go through these
+// nil-safe accessors.
+
+func (s Self) hostUUID() string {
+	if s.Host == nil {
+		return ""
+	}
+	return s.Host.UUID
+}
+
+func (s Self) stackName() string {
+	if s.Stack == nil {
+		return ""
+	}
+	return s.Stack.Name
+}
+
+func (s Self) serviceName() string {
+	if s.Service == nil {
+		return ""
+	}
+	return s.Service.Name
 }
 
 // GetHost returns the Host with the given UUID. If the argument is omitted
@@ -30,7 +69,7 @@ func (c *TemplateContext) GetHost(v ...string) (Host, error) {
 		uuid = v[0]
 	}
 	if uuid == "" {
-		uuid = c.Self.Host.UUID
+		uuid = c.Self.hostUUID()
 	}
 
 	for _, h := range c.Hosts {
@@ -52,14 +91,14 @@ func (c *TemplateContext) GetService(v ...string) (Service, error) {
 	}
 	var stack, service string
 	if identifier == "" {
-		stack = c.Self.Stack.Name
-		service = c.Self.Service.Name
+		stack = c.Self.stackName()
+		service = c.Self.serviceName()
 	} else {
 		parts := strings.Split(identifier, ".")
 		switch len(parts) {
 		case 1:
 			service = parts[0]
-			stack = c.Self.Stack.Name
+			stack = c.Self.stackName()
 		case 2:
 			service = parts[0]
 			stack = parts[1]
@@ -85,7 +124,7 @@ func (c *TemplateContext) GetStack(v ...string) (Stack, error) {
 
 	var stack string
 	if identifier == "" {
-		stack = c.Self.Stack.Name
+		stack = c.Self.stackName()
 	} else {
 		stack = identifier
 	}
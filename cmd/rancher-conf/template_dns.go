@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// rancherDomain is the domain of the internal DNS of Rancher.
+const rancherDomain = "rancher.internal"
+
+// serviceFqdn returns the name of a service in the internal DNS,
+// '<service>.<stack>.rancher.internal'.
+func serviceFqdn(service, stack string) string {
+	return strings.ToLower(service + "." + stack + "." + rancherDomain)
+}
+
+// containerFqdn returns the name of a container in the internal DNS,
+// '<container>.rancher.internal'.
+func containerFqdn(name string) string {
+	return strings.ToLower(name + "." + rancherDomain)
+}
+
+// SRVRecord is a DNS SRV record pointing to a port of a container.
+type SRVRecord struct {
+	Name     string
+	Target   string
+	Port     int
+	Protocol string
+	Priority int
+	Weight   int
+}
+
+// String returns the record in zone file format, e.g.
+// '_web._tcp.web.prod.rancher.internal. IN SRV 0 1 80 prod-web-1.rancher.internal.'
+func (r SRVRecord) String() string {
+	return fmt.Sprintf("%s. IN SRV %d %d %d %s.", r.Name, r.Priority, r.Weight, r.Port, r.Target)
+}
+
+// srvRecords returns an SRV record for every port of the service and each
+// of its containers, named '_<label>._<protocol>.<service fqdn>'. The label
+// defaults to the name of the service.
+func srvRecords(s *Service, label ...string) ([]SRVRecord, error) {
+	records := make([]SRVRecord, 0)
+	if s == nil {
+		return records, nil
+	}
+
+	name := s.Name
+	if len(label) > 0 && label[0] != "" {
+		name = label[0]
+	}
+
+	for _, p := range s.Ports {
+		port, err := strconv.Atoi(p.InternalPort)
+		if err != nil {
+			return nil, fmt.Errorf("(srvRecords) invalid port '%s' of service %s", p.InternalPort, serviceId(s))
+		}
+		proto := strings.ToLower(p.Protocol)
+		if proto == "" {
+			proto = "tcp"
+		}
+		for _, c := range s.Containers {
+			records = append(records, SRVRecord{
+				Name:     strings.ToLower(fmt.Sprintf("_%s._%s.%s", name, proto, s.Fqdn)),
+				Target:   c.Fqdn,
+				Port:     port,
+				Protocol: proto,
+				Weight:   1,
+			})
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const (
+	engineGo      = "go"
+	enginePongo2  = "pongo2"
+	engineJsonnet = "jsonnet"
+)
+
+// templateEngine returns the normalized name of the engine used to render t.
+// Templates without an explicit engine are rendered with text/template.
+func templateEngine(t Template) (string, error) {
+	switch strings.ToLower(t.Engine) {
+	case "", engineGo, "gotemplate":
+		return engineGo, nil
+	case enginePongo2, "jinja2", "jinja":
+		return enginePongo2, nil
+	case engineJsonnet:
+		return engineJsonnet, nil
+	default:
+		return "", fmt.Errorf("Unknown template engine '%s'", t.Engine)
+	}
+}
+
+// templateData is the data passed to Go templates as dot.
+type templateData struct {
+	Vars         VarMap
+	Environments map[string]*Environment
+	Runner       RunnerInfo
+}
+
+// templateData returns the data t is rendered with in the current cycle.
+func (r *runner) templateData(t Template, ctx *TemplateContext) templateData {
+	return templateData{Vars: r.templateVars(t), Environments: ctx.Environments, Runner: r.info}
+}
+
+// templateVars returns the global variables merged with the variables of
+// the template.
+func (r *runner) templateVars(t Template) VarMap {
+	vars := VarMap{}
+	for key, value := range r.Config.Vars {
+		vars[key] = value
+	}
+	for key, value := range t.Vars {
+		vars[key] = value
+	}
+	return vars
+}
+
+// renderTemplate renders the template source of t with the engine
+// configured for it.
+func (r *runner) renderTemplate(ctx *TemplateContext, funcs template.FuncMap, t Template, entry *cachedTemplate) ([]byte, error) {
+	engine, err := templateEngine(t)
+	if err != nil {
+		return nil, err
+	}
+
+	r.versionFuncs(t, funcs)
+
+	data := r.templateData(t, ctx)
+	switch engine {
+	case enginePongo2:
+		return renderPongo2(funcs, t, entry.source, data)
+	case engineJsonnet:
+		return r.renderJsonnet(ctx, t, data)
+	}
+
+	lib := &templateLib{}
+	if r.Config.TemplateLibDir != "" {
+		if lib, err = r.Cache.LoadLib(r.Config.TemplateLibDir); err != nil {
+			return nil, fmt.Errorf("Could not load template library: %v", err)
+		}
+	}
+	return renderGoTemplate(funcs, t, entry, lib, data)
+}
+
+// renderGoTemplate renders a text/template. The files of the template
+// library are parsed into the namespace of the template first, so the
+// template can override the blocks they define.
+func renderGoTemplate(funcs template.FuncMap, t Template, entry *cachedTemplate, lib *templateLib, data templateData) ([]byte, error) {
+	name := filepath.Base(t.Source)
+	sources := map[string][]byte{name: entry.source}
+	for i, libName := range lib.names {
+		sources[libName] = lib.entries[i].source
+	}
+
+	var tmpl *template.Template
+	// copied from: https://github.com/helm/helm/blob/8648ccf5d35d682dcd5f7a9c2082f0aaf071e817/pkg/engine/engine.go#L147-L154
+	funcs["include"] = func(name string, data interface{}) (string, error) {
+		buf := bytes.NewBuffer(nil)
+		if err := tmpl.ExecuteTemplate(buf, name, data); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+
+	if entry.compiled == nil || entry.libVersion != lib.version {
+		compiled := template.New(name).Funcs(funcs)
+		for i, libName := range lib.names {
+			if _, err := compiled.New(libName).Parse(string(lib.entries[i].source)); err != nil {
+				return nil, newTemplateError(err, sources)
+			}
+		}
+		if _, err := compiled.Parse(string(entry.source)); err != nil {
+			return nil, newTemplateError(err, sources)
+		}
+		entry.compiled = compiled
+		entry.libVersion = lib.version
+	}
+
+	// The functions are bound to the context of the current cycle, so
+	// they are replaced before every execution of the cached template.
+	tmpl = entry.compiled.Funcs(funcs)
+
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, data); err != nil {
+		return nil, newTemplateError(err, sources)
+	}
+
+	return buf.Bytes(), nil
+}
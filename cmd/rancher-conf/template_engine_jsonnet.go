@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	log "github.com/sirupsen/logrus"
+)
+
+// renderJsonnet evaluates a Jsonnet file with the exported context available
+// as std.extVar("ctx"), the variables as std.extVar("vars") and the runner
+// information as std.extVar("runner"). The result is JSON, or YAML if the
+// template's format is set to "yaml". Evaluation is delegated to the
+// jsonnet command line tool.
+func (r *runner) renderJsonnet(ctx *TemplateContext, t Template, data templateData) ([]byte, error) {
+	// the values are passed in files, as command lines are limited in
+	// length and visible to other processes
+	extVars := []struct {
+		name  string
+		value interface{}
+	}{
+		{"ctx", ctx.Export()},
+		{"vars", data.Vars},
+		{"runner", data.Runner},
+	}
+
+	args := make([]string, 0)
+	for _, v := range extVars {
+		file, err := writeExtCodeFile(v.name, v.value)
+		if err != nil {
+			return nil, err
+		}
+		defer removeTemp(file)
+		args = append(args, "--ext-code-file", v.name+"="+file)
+	}
+
+	bin := r.Config.JsonnetPath
+	if bin == "" {
+		bin = "jsonnet"
+	}
+
+	args = append(args, "-J", filepath.Dir(t.Source), t.Source)
+
+	log.Debugf("Evaluating jsonnet: %s %s", bin, strings.Join(args, " "))
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(bin, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := runChild(cmd); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	if format, _ := jsonnetFormat(t); format == "yaml" {
+		return yaml.JSONToYAML(stdout.Bytes())
+	}
+	return stdout.Bytes(), nil
+}
+
+// jsonnetFormat returns the normalized output format of the Jsonnet
+// template t.
+func jsonnetFormat(t Template) (string, error) {
+	switch strings.ToLower(t.Format) {
+	case "", "json":
+		return "json", nil
+	case "yaml", "yml":
+		return "yaml", nil
+	default:
+		return "", fmt.Errorf("Unknown output format '%s'", t.Format)
+	}
+}
+
+// checkJsonnetConfig verifies the output format of the Jsonnet template t
+// and that the jsonnet binary it is evaluated with can be found.
+func checkJsonnetConfig(t Template, bin string) error {
+	if _, err := jsonnetFormat(t); err != nil {
+		return err
+	}
+	if bin == "" {
+		bin = "jsonnet"
+	}
+	if _, err := exec.LookPath(bin); err != nil {
+		return fmt.Errorf("Jsonnet binary '%s' not found: %v", bin, err)
+	}
+	return nil
+}
+
+// writeExtCodeFile writes value as JSON to a temporary file for the Jsonnet
+// external variable name and returns the path of the file. The caller has to
+// remove it with removeTemp.
+func writeExtCodeFile(name string, value interface{}) (string, error) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("Could not serialize %s: %v", name, err)
+	}
+
+	fp, err := ioutil.TempFile("", "rancher-conf-"+name+"-")
+	if err != nil {
+		return "", fmt.Errorf("Could not create %s file: %v", name, err)
+	}
+	trackTemp(fp.Name())
+
+	_, err = fp.Write(content)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		removeTemp(fp.Name())
+		return "", fmt.Errorf("Could not write %s file: %v", name, err)
+	}
+	return fp.Name(), nil
+}
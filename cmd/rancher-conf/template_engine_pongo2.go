@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"text/template"
+
+	"github.com/flosch/pongo2/v4"
+)
+
+// renderPongo2 renders a Jinja2-style template. All template functions are
+// exposed as callables in the pongo2 context, e.g. {{ service("web.prod") }},
+// the variables as Vars, the additional environments as Environments and the
+// runner information as Runner. Includes and extends are resolved relative
+// to the template's directory.
+func renderPongo2(funcs template.FuncMap, t Template, tmplBytes []byte, data templateData) ([]byte, error) {
+	loader, err := pongo2.NewLocalFileSystemLoader(filepath.Dir(t.Source))
+	if err != nil {
+		return nil, err
+	}
+
+	set := pongo2.NewSet(filepath.Base(t.Source), loader)
+	tpl, err := set.FromBytes(tmplBytes)
+	if err != nil {
+		return nil, newPongo2Error(err, t, tmplBytes)
+	}
+
+	ctx := pongo2.Context{}
+	for name, fn := range funcs {
+		ctx[name] = fn
+	}
+	ctx["Vars"] = data.Vars
+	ctx["Environments"] = data.Environments
+	ctx["Runner"] = data.Runner
+
+	content, err := tpl.ExecuteBytes(ctx)
+	if err != nil {
+		return nil, newPongo2Error(err, t, tmplBytes)
+	}
+
+	return content, nil
+}
+
+// newPongo2Error converts a pongo2 error into a TemplateError.
+func newPongo2Error(err error, t Template, tmplBytes []byte) error {
+	perr, ok := err.(*pongo2.Error)
+	if !ok || perr.Line == 0 {
+		return err
+	}
+
+	e := &TemplateError{
+		Template: filepath.Base(t.Source),
+		Line:     perr.Line,
+		Column:   perr.Column,
+		Message:  err.Error(),
+		source:   tmplBytes,
+	}
+	if perr.OrigError != nil {
+		e.Message = perr.OrigError.Error()
+	}
+
+	// errors in included templates carry the name of the included file
+	if perr.Filename != "" && perr.Filename != "<string>" {
+		e.Template = perr.Filename
+		e.source, _ = ioutil.ReadFile(perr.Filename)
+	}
+
+	if perr.Sender != "" {
+		e.Message = fmt.Sprintf("[%s] %s", perr.Sender, e.Message)
+	}
+
+	return e
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// snippetContext is the number of lines shown before and after the
+// offending line of a template error.
+const snippetContext = 2
+
+var (
+	// matches "template: <name>:<line>[:<col>]: <message>"
+	templateErrorRx = regexp.MustCompile(`^template: (.+?):(\d+)(?::(\d+))?: (?s)(.*)$`)
+	// matches `executing "<name>" at <<expression>>: <message>`
+	executeErrorRx = regexp.MustCompile(`^executing "[^"]*" at <(.*?)>: (?s)(.*)$`)
+	// matches the field chains of an expression, e.g. ".Service.Name" or
+	// "$c.Host"
+	fieldChainRx = regexp.MustCompile(`(?:^|[^\w.])\$?\w*((?:\.[A-Za-z_]\w*)+)`)
+	// matches "can't evaluate field <field> in type <type>"
+	evalFieldRx = regexp.MustCompile(`can't evaluate field (\w+) in type (\S+)`)
+)
+
+// TemplateError describes a failure to parse or execute a template
+// including the location of the failure.
+type TemplateError struct {
+	Template   string
+	Line       int
+	Column     int
+	Expression string
+	// context field involved, e.g. "Service.Name" or "Container.Foo"
+	Field   string
+	Message string
+	source  []byte
+}
+
+func (e *TemplateError) Error() string {
+	msg := fmt.Sprintf("%s:%d", e.Template, e.Line)
+	if e.Column > 0 {
+		msg += fmt.Sprintf(":%d", e.Column)
+	}
+	if e.Expression != "" {
+		msg += fmt.Sprintf(": at <%s>", e.Expression)
+	}
+	if e.Field != "" {
+		msg += fmt.Sprintf(": field %s", e.Field)
+	}
+	return msg + ": " + e.Message
+}
+
+// Snippet returns the lines surrounding the location of the error. The
+// offending line is marked with '>' and followed by a caret pointing at the
+// column if it is known.
+func (e *TemplateError) Snippet() []string {
+	if e.source == nil || e.Line < 1 {
+		return nil
+	}
+
+	lines := strings.Split(string(e.source), "\n")
+	if e.Line > len(lines) {
+		return nil
+	}
+
+	first := e.Line - snippetContext
+	if first < 1 {
+		first = 1
+	}
+	last := e.Line + snippetContext
+	if last > len(lines) {
+		last = len(lines)
+	}
+
+	width := len(strconv.Itoa(last))
+	snippet := make([]string, 0, last-first+2)
+	for n := first; n <= last; n++ {
+		marker := " "
+		if n == e.Line {
+			marker = ">"
+		}
+		snippet = append(snippet, fmt.Sprintf("%s %*d | %s", marker, width, n, lines[n-1]))
+		if n == e.Line && e.Column > 0 {
+			snippet = append(snippet, fmt.Sprintf("  %*s | %s^", width, "", strings.Repeat(" ", e.Column-1)))
+		}
+	}
+
+	return snippet
+}
+
+// newTemplateError converts an error returned by text/template into a
+// TemplateError. sources maps template names to their content and is used to
+// build the snippet. Errors that don't carry a location are returned as is.
+func newTemplateError(err error, sources map[string][]byte) error {
+	m := templateErrorRx.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+
+	e := &TemplateError{Template: m[1], Message: m[4]}
+	e.Line, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		// text/template reports zero-based byte offsets
+		col, _ := strconv.Atoi(m[3])
+		e.Column = col + 1
+	}
+
+	if x := executeErrorRx.FindStringSubmatch(e.Message); x != nil {
+		e.Expression = x[1]
+		e.Message = x[2]
+		e.Field = contextField(e.Expression, e.Message)
+	}
+
+	e.source = sources[e.Template]
+	return e
+}
+
+// contextField returns the context field involved in a failed expression.
+// If the field doesn't exist, it is qualified with the type it was looked
+// up in, otherwise it is the last field chain of the expression.
+func contextField(expr, msg string) string {
+	if m := evalFieldRx.FindStringSubmatch(msg); m != nil {
+		typ := strings.TrimLeft(m[2], "*")
+		if i := strings.LastIndex(typ, "."); i >= 0 {
+			typ = typ[i+1:]
+		}
+		return typ + "." + m[1]
+	}
+
+	chains := fieldChainRx.FindAllStringSubmatch(expr, -1)
+	if len(chains) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(chains[len(chains)-1][1], ".")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"text/template"
+)
+
+func TestNewTemplateError(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		data   interface{}
+		want   TemplateError
+	}{
+		{
+			"parse error",
+			"a\n{{if}}\n",
+			nil,
+			TemplateError{Template: "t.tmpl", Line: 2, Message: "missing value for if"},
+		},
+		{
+			"unknown field",
+			"{{.Name}}\n  {{.Stack.Nope}}",
+			&Service{Stack: &Stack{}},
+			TemplateError{Template: "t.tmpl", Line: 2, Column: 11, Expression: ".Stack.Nope", Field: "Stack.Nope",
+				Message: "can't evaluate field Nope in type *main.Stack"},
+		},
+		{
+			"failing method",
+			"{{range .Ports}}{{.Public}}{{end}}",
+			&Service{Ports: []ServicePort{{version: contextV1}}},
+			TemplateError{Template: "t.tmpl", Line: 1, Column: 19, Expression: ".Public", Field: "Public",
+				Message: "error calling Public: Field .Public requires context-version = 2"},
+		},
+		{
+			"variable",
+			"{{$p := index .Ports 0}}{{$p.Bind}}",
+			&Service{Ports: []ServicePort{{version: contextV1}}},
+			TemplateError{Template: "t.tmpl", Line: 1, Column: 29, Expression: "$p.Bind", Field: "Bind",
+				Message: "error calling Bind: Field .Bind requires context-version = 2"},
+		},
+		{
+			"function",
+			`{{index .Labels "a" | len | printf "%d" | fail}}`,
+			&Service{},
+			TemplateError{Template: "t.tmpl", Line: 1, Column: 43, Expression: "fail", Message: "error calling fail: failed"},
+		},
+	}
+
+	funcs := template.FuncMap{"fail": func(string) (string, error) { return "", errors.New("failed") }}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := template.New("t.tmpl").Funcs(funcs).Parse(tt.source)
+			if err == nil {
+				err = tmpl.Execute(ioutil.Discard, tt.data)
+			}
+			if err == nil {
+				t.Fatal("template did not fail")
+			}
+
+			got, ok := newTemplateError(err, map[string][]byte{"t.tmpl": []byte(tt.source)}).(*TemplateError)
+			if !ok {
+				t.Fatalf("newTemplateError(%q) is no TemplateError", err)
+			}
+			tt.want.source = []byte(tt.source)
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("newTemplateError(%q) = %+v, want %+v", err, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTemplateErrorWithoutLocation(t *testing.T) {
+	err := errors.New("Could not read template")
+	if got := newTemplateError(err, nil); got != err {
+		t.Errorf("newTemplateError() = %v, want %v", got, err)
+	}
+}
+
+func TestTemplateErrorError(t *testing.T) {
+	tests := []struct {
+		err  TemplateError
+		want string
+	}{
+		{TemplateError{Template: "a.tmpl", Line: 3, Message: "m"}, "a.tmpl:3: m"},
+		{TemplateError{Template: "a.tmpl", Line: 3, Column: 7, Message: "m"}, "a.tmpl:3:7: m"},
+		{TemplateError{Template: "a.tmpl", Line: 3, Column: 7, Expression: ".A.B", Field: "A.B", Message: "m"}, "a.tmpl:3:7: at <.A.B>: field A.B: m"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("Error() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestTemplateErrorSnippet(t *testing.T) {
+	source := []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11")
+	tests := []struct {
+		name   string
+		line   int
+		column int
+		want   []string
+	}{
+		{"first line", 1, 0, []string{"> 1 | 1", "  2 | 2", "  3 | 3"}},
+		{"column", 5, 1, []string{"  3 | 3", "  4 | 4", "> 5 | 5", "    | ^", "  6 | 6", "  7 | 7"}},
+		{"wider numbers", 10, 2, []string{"   8 | 8", "   9 | 9", "> 10 | 10", "     |  ^", "  11 | 11"}},
+		{"beyond the source", 12, 0, nil},
+		{"no line", 0, 0, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &TemplateError{Line: tt.line, Column: tt.column, source: source}
+			if got := e.Snippet(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Snippet() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"github.com/finboxio/go-rancher-metadata/metadata"
+)
+
+// The context graph contains reference cycles (services point to their
+// stack, which points back to its services), so it can't be serialized
+// directly. The exported types below replace object references with
+// identifiers: hosts and containers are referenced by UUID, services by
+// "<service>.<stack>" and stacks by name.
+
+type exportedContext struct {
+	Stacks     []exportedStack     `json:"stacks"`
+	Services   []exportedService   `json:"services"`
+	Containers []exportedContainer `json:"containers"`
+	Hosts      []exportedHost      `json:"hosts"`
+	Self       exportedSelf        `json:"self"`
+	Derived    interface{}         `json:"derived,omitempty"`
+
+	MetadataVersion string                         `json:"metadata_version"`
+	Environments    map[string]exportedEnvironment `json:"environments,omitempty"`
+}
+
+type exportedEnvironment struct {
+	Name       string              `json:"name"`
+	Stacks     []exportedStack     `json:"stacks"`
+	Services   []exportedService   `json:"services"`
+	Containers []exportedContainer `json:"containers"`
+	Hosts      []exportedHost      `json:"hosts"`
+
+	MetadataVersion string `json:"metadata_version"`
+}
+
+type exportedSelf struct {
+	Stack       *exportedStack     `json:"stack"`
+	Service     *exportedService   `json:"service"`
+	Container   *exportedContainer `json:"container"`
+	Host        *exportedHost      `json:"host"`
+	PeerIds     []string           `json:"peer_ids"`
+	SiblingIds  []string           `json:"sibling_ids"`
+	NeighborIds []string           `json:"neighbor_ids"`
+}
+
+type exportedStack struct {
+	metadata.Stack
+	ServiceIds []string `json:"service_ids"`
+}
+
+type exportedHost struct {
+	metadata.Host
+	ContainerIds []string `json:"container_ids"`
+}
+
+type exportedService struct {
+	metadata.Service
+	Id           string        `json:"id"`
+	ExternalFqdn string        `json:"external_fqdn,omitempty"`
+	ParsedPorts  []ServicePort `json:"parsed_ports"`
+	Primary      bool          `json:"primary"`
+	Sidekick     bool          `json:"sidekick"`
+	Parent       string        `json:"parent,omitempty"`
+	SidekickIds  []string      `json:"sidekick_ids"`
+	ContainerIds []string      `json:"container_ids"`
+}
+
+type exportedContainer struct {
+	metadata.Container
+	Fqdn        string        `json:"fqdn"`
+	ParsedPorts []ServicePort `json:"parsed_ports"`
+	Primary     bool          `json:"primary"`
+	Sidekick    bool          `json:"sidekick"`
+	Service     string        `json:"service,omitempty"`
+	Parent      string        `json:"parent,omitempty"`
+	SidekickIds []string      `json:"sidekick_ids"`
+}
+
+func serviceId(s *Service) string {
+	if s == nil {
+		return ""
+	}
+	if s.Stack == nil {
+		return s.Name
+	}
+	return s.Name + "." + s.Stack.Name
+}
+
+func exportStack(s *Stack) exportedStack {
+	e := exportedStack{Stack: s.Stack, ServiceIds: make([]string, 0)}
+	e.Services = nil
+	for _, svc := range s.Services {
+		e.ServiceIds = append(e.ServiceIds, serviceId(svc))
+	}
+	return e
+}
+
+func exportHost(h *Host) exportedHost {
+	e := exportedHost{Host: h.Host, ContainerIds: make([]string, 0)}
+	for _, c := range h.Containers {
+		e.ContainerIds = append(e.ContainerIds, c.UUID)
+	}
+	return e
+}
+
+func exportService(s *Service) exportedService {
+	e := exportedService{
+		Service:      s.Service,
+		Id:           serviceId(s),
+		ExternalFqdn: s.ExternalFqdn,
+		ParsedPorts:  s.Ports,
+		Primary:      s.Primary,
+		Sidekick:     s.Sidekick,
+		Parent:       serviceId(s.Parent),
+		SidekickIds:  make([]string, 0),
+		ContainerIds: make([]string, 0),
+	}
+	e.Service.Containers = nil
+	e.Service.Fqdn = s.Fqdn
+	for _, sk := range s.Sidekicks {
+		e.SidekickIds = append(e.SidekickIds, serviceId(sk))
+	}
+	for _, c := range s.Containers {
+		e.ContainerIds = append(e.ContainerIds, c.UUID)
+	}
+	return e
+}
+
+func exportContainer(c *Container) exportedContainer {
+	e := exportedContainer{
+		Container:   c.Container,
+		Fqdn:        c.Fqdn,
+		ParsedPorts: c.Ports,
+		Primary:     c.Primary,
+		Sidekick:    c.Sidekick,
+		Service:     serviceId(c.Service),
+		SidekickIds: make([]string, 0),
+	}
+	if c.Parent != nil {
+		e.Parent = c.Parent.UUID
+	}
+	for _, sk := range c.Sidekicks {
+		e.SidekickIds = append(e.SidekickIds, sk.UUID)
+	}
+	return e
+}
+
+// Export returns a JSON-serializable representation of the context.
+func (c *TemplateContext) Export() interface{} {
+	e := exportedContext{
+		Stacks:     make([]exportedStack, 0, len(c.Stacks)),
+		Services:   make([]exportedService, 0, len(c.Services)),
+		Containers: make([]exportedContainer, 0, len(c.Containers)),
+		Hosts:      make([]exportedHost, 0, len(c.Hosts)),
+		Derived:    c.Derived,
+
+		MetadataVersion: c.MetadataVersion,
+	}
+
+	for _, s := range c.Stacks {
+		e.Stacks = append(e.Stacks, exportStack(s))
+	}
+	for _, s := range c.Services {
+		e.Services = append(e.Services, exportService(s))
+	}
+	for _, ct := range c.Containers {
+		e.Containers = append(e.Containers, exportContainer(ct))
+	}
+	for _, h := range c.Hosts {
+		e.Hosts = append(e.Hosts, exportHost(h))
+	}
+
+	if c.Self.Stack != nil {
+		s := exportStack(c.Self.Stack)
+		e.Self.Stack = &s
+	}
+	if c.Self.Service != nil {
+		s := exportService(c.Self.Service)
+		e.Self.Service = &s
+	}
+	if c.Self.Container != nil {
+		ct := exportContainer(c.Self.Container)
+		e.Self.Container = &ct
+	}
+	if c.Self.Host != nil {
+		h := exportHost(c.Self.Host)
+		e.Self.Host = &h
+	}
+	e.Self.PeerIds = containerIds(c.Self.Peers())
+	e.Self.SiblingIds = containerIds(c.Self.Siblings())
+	e.Self.NeighborIds = containerIds(c.Self.Neighbors())
+
+	if len(c.Environments) > 0 {
+		e.Environments = make(map[string]exportedEnvironment, len(c.Environments))
+		for name, env := range c.Environments {
+			e.Environments[name] = exportEnvironment(env)
+		}
+	}
+
+	return e
+}
+
+func exportEnvironment(env *Environment) exportedEnvironment {
+	e := exportedEnvironment{
+		Name:       env.Name,
+		Stacks:     make([]exportedStack, 0, len(env.Stacks)),
+		Services:   make([]exportedService, 0, len(env.Services)),
+		Containers: make([]exportedContainer, 0, len(env.Containers)),
+		Hosts:      make([]exportedHost, 0, len(env.Hosts)),
+
+		MetadataVersion: env.MetadataVersion,
+	}
+	for _, s := range env.Stacks {
+		e.Stacks = append(e.Stacks, exportStack(s))
+	}
+	for _, s := range env.Services {
+		e.Services = append(e.Services, exportService(s))
+	}
+	for _, ct := range env.Containers {
+		e.Containers = append(e.Containers, exportContainer(ct))
+	}
+	for _, h := range env.Hosts {
+		e.Hosts = append(e.Hosts, exportHost(h))
+	}
+	return e
+}
+
+func containerIds(containers []*Container) []string {
+	ids := make([]string, 0, len(containers))
+	for _, c := range containers {
+		ids = append(ids, c.UUID)
+	}
+	return ids
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// envKeyPattern matches valid names of environment variables.
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// toEnvFile serializes a map into the env-file format understood by Docker,
+// systemd and shells. Values that contain whitespace or special characters
+// are double quoted. Nested values are encoded as JSON.
+// Example:
+//    {{(service).Metadata | toEnvFile}}
+func toEnvFile(in interface{}) (string, error) {
+	m, err := stringKeyedMap("toEnvFile", in)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, key := range sortedKeys(m) {
+		if !envKeyPattern.MatchString(key) {
+			return "", fmt.Errorf("(toEnvFile) invalid variable name '%s'", key)
+		}
+		b.WriteString(key + "=" + quoteEnvValue(formatValue(m[key])) + "\n")
+	}
+	return b.String(), nil
+}
+
+func quoteEnvValue(s string) string {
+	if s != "" && strings.IndexFunc(s, needsEnvQuoting) < 0 {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`", "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+func needsEnvQuoting(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("_-.,:/@%+=", r))
+}
+
+// toProperties serializes a map into the Java properties format. Nested
+// maps are flattened into keys joined with '.'.
+// Example:
+//    {{(service).Metadata | toProperties}}
+func toProperties(in interface{}) (string, error) {
+	m, err := stringKeyedMap("toProperties", in)
+	if err != nil {
+		return "", err
+	}
+
+	flat := make(map[string]interface{})
+	flattenMap("", m, flat)
+
+	var b strings.Builder
+	for _, key := range sortedKeys(flat) {
+		b.WriteString(escapeProperty(key, true) + "=" + escapeProperty(formatValue(flat[key]), false) + "\n")
+	}
+	return b.String(), nil
+}
+
+// escapeProperty escapes a key or value of a properties file. Characters
+// outside of ISO 8859-1 are written as unicode escapes.
+func escapeProperty(s string, key bool) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\f':
+			b.WriteString(`\f`)
+		case r == ' ' && (key || i == 0):
+			b.WriteString(`\ `)
+		case strings.ContainsRune("=:#!", r):
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			for _, u := range utf16Units(r) {
+				fmt.Fprintf(&b, `\u%04x`, u)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func utf16Units(r rune) []rune {
+	if r < 0x10000 {
+		return []rune{r}
+	}
+	r -= 0x10000
+	return []rune{0xd800 + (r>>10)&0x3ff, 0xdc00 + r&0x3ff}
+}
+
+// toINI serializes a map into the INI format. Nested maps at the top level
+// become sections, deeper nesting is flattened into keys joined with '.'.
+// Example:
+//    {{derived "config" | toINI}}
+func toINI(in interface{}) (string, error) {
+	m, err := stringKeyedMap("toINI", in)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	sections := make([]string, 0)
+	for _, key := range sortedKeys(m) {
+		if _, err := stringKeyedMap("toINI", m[key]); err == nil && m[key] != nil {
+			sections = append(sections, key)
+			continue
+		}
+		b.WriteString(key + " = " + quoteINIValue(formatValue(m[key])) + "\n")
+	}
+
+	for _, section := range sections {
+		sm, _ := stringKeyedMap("toINI", m[section])
+		flat := make(map[string]interface{})
+		flattenMap("", sm, flat)
+
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString("[" + section + "]\n")
+		for _, key := range sortedKeys(flat) {
+			b.WriteString(key + " = " + quoteINIValue(formatValue(flat[key])) + "\n")
+		}
+	}
+	return b.String(), nil
+}
+
+func quoteINIValue(s string) string {
+	if s == strings.TrimSpace(s) && !strings.ContainsAny(s, ";#\"\\\n\r") {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// stringKeyedMap converts any map with string keys, e.g. a LabelMap or
+// MetadataMap, into a map[string]interface{}.
+func stringKeyedMap(funcName string, in interface{}) (map[string]interface{}, error) {
+	if in == nil {
+		return nil, fmt.Errorf("(%s) input is nil", funcName)
+	}
+
+	v := reflect.ValueOf(in)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return nil, fmt.Errorf("(%s) invalid input type %T", funcName, in)
+	}
+
+	m := make(map[string]interface{}, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		m[iter.Key().String()] = iter.Value().Interface()
+	}
+	return m, nil
+}
+
+func flattenMap(prefix string, in, out map[string]interface{}) {
+	for key, value := range in {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		if nested, err := stringKeyedMap("", value); err == nil && value != nil {
+			flattenMap(key, nested, out)
+			continue
+		}
+		out[key] = value
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatValue returns the string representation of a value. Lists and maps
+// are encoded as JSON.
+func formatValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		if buf, err := json.Marshal(v); err == nil {
+			return string(buf)
+		}
+	}
+	return fmt.Sprint(v)
+}
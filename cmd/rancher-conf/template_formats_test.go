@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestToEnvFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      interface{}
+		want    string
+		wantErr bool
+	}{
+		{"empty", map[string]string{}, "", false},
+		{"plain", map[string]string{"B": "2", "A": "1"}, "A=1\nB=2\n", false},
+		{"empty value", map[string]string{"A": ""}, "A=\"\"\n", false},
+		{"whitespace", map[string]string{"A": "a b"}, "A=\"a b\"\n", false},
+		{"special characters", map[string]string{"A": "$x\"`\\"}, "A=\"\\$x\\\"\\`\\\\\"\n", false},
+		{"newline", map[string]string{"A": "a\nb"}, "A=\"a\\nb\"\n", false},
+		{"url", map[string]string{"URL": "http://host:80/path"}, "URL=http://host:80/path\n", false},
+		{"label map", LabelMap{"A": "1"}, "A=1\n", false},
+		{"nested", map[string]interface{}{"A": []int{1, 2}}, "A=\"[1,2]\"\n", false},
+		{"invalid name", map[string]string{"1A": "1"}, "", true},
+		{"nil", nil, "", true},
+		{"not a map", []string{"A"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := toEnvFile(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("toEnvFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("toEnvFile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToProperties(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      interface{}
+		want    string
+		wantErr bool
+	}{
+		{"plain", map[string]string{"b": "2", "a": "1"}, "a=1\nb=2\n", false},
+		{"nested", map[string]interface{}{"db": map[string]interface{}{"host": "x", "port": 5432}}, "db.host=x\ndb.port=5432\n", false},
+		{"separators", map[string]string{"a=b": "c:d#e!"}, "a\\=b=c\\:d\\#e\\!\n", false},
+		{"spaces", map[string]string{"a b": " c d"}, "a\\ b=\\ c d\n", false},
+		{"control characters", map[string]string{"a": "\t\n\r\f\\"}, "a=\\t\\n\\r\\f\\\\\n", false},
+		{"latin1", map[string]string{"a": "é"}, "a=\\u00e9\n", false},
+		{"surrogate pair", map[string]string{"a": "😀"}, "a=\\ud83d\\ude00\n", false},
+		{"nil", nil, "", true},
+		{"not a map", "a=b", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := toProperties(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("toProperties() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("toProperties() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToINI(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      interface{}
+		want    string
+		wantErr bool
+	}{
+		{"plain", map[string]string{"b": "2", "a": "1"}, "a = 1\nb = 2\n", false},
+		{
+			"sections",
+			map[string]interface{}{
+				"name": "x",
+				"db":   map[string]interface{}{"host": "h", "opts": map[string]interface{}{"ssl": true}},
+				"app":  map[string]string{"port": "80"},
+			},
+			"name = x\n\n[app]\nport = 80\n\n[db]\nhost = h\nopts.ssl = true\n",
+			false,
+		},
+		{"only sections", map[string]interface{}{"s": map[string]string{"a": "1"}}, "[s]\na = 1\n", false},
+		{"quoted", map[string]string{"a": " x ", "b": "c;d", "c": "e\"f"}, "a = \" x \"\nb = \"c;d\"\nc = \"e\\\"f\"\n", false},
+		{"list", map[string]interface{}{"a": []int{1, 2}}, "a = [1,2]\n", false},
+		{"quoted list", map[string]interface{}{"a": []string{"x"}}, "a = \"[\\\"x\\\"]\"\n", false},
+		{"nil value", map[string]interface{}{"a": nil}, "a = \n", false},
+		{"nil", nil, "", true},
+		{"not string keys", map[int]string{1: "a"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := toINI(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("toINI() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("toINI() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
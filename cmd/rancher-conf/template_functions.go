@@ -36,6 +36,9 @@ func newFuncMap(ctx *TemplateContext) template.FuncMap {
 		"isJSONObject": isJSONObject,
 		"unflatten": 		inflate,
 		"yaml":					toYaml,
+		"toEnvFile":    toEnvFile,
+		"toProperties": toProperties,
+		"toINI":        toINI,
 		"url": 					parseUrl,
 		"cpus": 				runtime.NumCPU,
 
@@ -47,10 +50,19 @@ func newFuncMap(ctx *TemplateContext) template.FuncMap {
 		"services":          servicesFunc(ctx),
 		"stack": 						 stackFunc(ctx),
 		"stacks": 					 stacksFunc(ctx),
+		"derived":           derivedFunc(ctx),
+		"metadataVersion":   metadataVersionFunc(ctx),
 		"whereLabelExists":  whereLabelExists,
 		"whereLabelEquals":  whereLabelEquals,
 		"whereLabelMatches": whereLabelEquals,
 		"groupByLabel":      groupByLabel,
+		"sortBy":            sortBy,
+		"running":           running,
+		"healthy":           healthy,
+		"inState":           inState,
+		"onSameHost":        onSameHost,
+		"hostsWithLabel":    hostsWithLabelFunc(ctx),
+		"srvRecords":        srvRecords,
 	}
 
 	for k, v := range sprig.TxtFuncMap() {
@@ -108,6 +120,23 @@ func stacksFunc(ctx *TemplateContext) func() (interface{}, error) {
 	}
 }
 
+// derivedFunc returns the values computed by the context script. Given a key
+// only the corresponding value is returned.
+func derivedFunc(ctx *TemplateContext) func(...string) (interface{}, error) {
+	return func(s ...string) (interface{}, error) {
+		if len(s) == 0 {
+			return ctx.Derived, nil
+		}
+		return ctx.Derived[s[0]], nil
+	}
+}
+
+// metadataVersionFunc returns the version of the metadata API.
+func metadataVersionFunc(ctx *TemplateContext) func() string {
+	return func() string {
+		return ctx.MetadataVersion
+	}
+}
 
 // hostFunc returns a single host given it's UUID.
 func hostFunc(ctx *TemplateContext) func(...string) (interface{}, error) {
@@ -241,6 +270,95 @@ func whereLabelMatches(label, pattern string, in interface{}) ([]interface{}, er
 	})
 }
 
+// activeStates are the container states that are included in the context
+// unless include-inactive is set. Containers with an empty state are
+// included as well.
+var activeStates = []string{"running", "starting", "restarting"}
+
+func isActiveState(state string) bool {
+	return state == "" || containsString(activeStates, state)
+}
+
+func filterContainers(funcName string, in interface{}, test func(*Container) bool) ([]*Container, error) {
+	result := make([]*Container, 0)
+	if in == nil {
+		return result, fmt.Errorf("(%s) input is nil", funcName)
+	}
+
+	switch typed := in.(type) {
+	case []*Container:
+		for _, c := range typed {
+			if test(c) {
+				result = append(result, c)
+			}
+		}
+	case []interface{}:
+		for _, item := range typed {
+			c, ok := item.(*Container)
+			if !ok {
+				return result, fmt.Errorf("(%s) invalid input type %T", funcName, item)
+			}
+			if test(c) {
+				result = append(result, c)
+			}
+		}
+	default:
+		return result, fmt.Errorf("(%s) invalid input type %T", funcName, in)
+	}
+
+	return result, nil
+}
+
+// selects the running containers from the input
+func running(in interface{}) ([]*Container, error) {
+	return filterContainers("running", in, func(c *Container) bool {
+		return c.State == "running"
+	})
+}
+
+// selects the running containers from the input that are healthy or have no
+// health check
+func healthy(in interface{}) ([]*Container, error) {
+	return filterContainers("healthy", in, isHealthy)
+}
+
+// isHealthy returns true if the container is running and healthy or has no
+// health check.
+func isHealthy(c *Container) bool {
+	return c.State == "running" && (c.HealthState == "healthy" || c.HealthState == "")
+}
+
+// selects the containers from the input that are in one of the given comma
+// separated states
+func inState(states string, in interface{}) ([]*Container, error) {
+	list := splitList(states)
+	return filterContainers("inState", in, func(c *Container) bool {
+		return containsString(list, c.State)
+	})
+}
+
+// selects the containers from the input that run on the same host as the
+// given container
+func onSameHost(c *Container, in interface{}) ([]*Container, error) {
+	return filterContainers("onSameHost", in, func(other *Container) bool {
+		return c != nil && c.HostUUID != "" && other.HostUUID == c.HostUUID
+	})
+}
+
+// hostsWithLabelFunc returns the hosts with the given label, given either
+// as 'key' or as 'key=value'.
+func hostsWithLabelFunc(ctx *TemplateContext) func(string) []*Host {
+	return func(label string) []*Host {
+		result := make([]*Host, 0)
+		for _, h := range ctx.Hosts {
+			if labelMatches(h.Labels, label) {
+				result = append(result, h)
+			}
+		}
+		return result
+	}
+}
+
 func isJSONArray(in interface{}) bool {
 	if _, ok := in.([]interface{}); ok {
 		return true
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The collections of the context are sorted in a fixed order, so renders are
+// reproducible and don't change if the metadata service returns objects in
+// a different order. The primary keys are those of earlier versions, so
+// existing destinations don't change; the other keys only break ties:
+//
+//   stacks:     UUID, name
+//   hosts:      UUID, host ID, hostname
+//   services:   UUID, stack name, name
+//   containers: create index, UUID, name
+//
+// Nested collections, e.g. the containers of a service, are sorted the same
+// way.
+
+func lessStack(a, b *Stack) bool {
+	if a.UUID != b.UUID {
+		return a.UUID < b.UUID
+	}
+	return a.Name < b.Name
+}
+
+func lessHost(a, b *Host) bool {
+	if a.UUID != b.UUID {
+		return a.UUID < b.UUID
+	}
+	if a.HostId != b.HostId {
+		return a.HostId < b.HostId
+	}
+	return a.Hostname < b.Hostname
+}
+
+func lessService(a, b *Service) bool {
+	if a.UUID != b.UUID {
+		return a.UUID < b.UUID
+	}
+	if a.StackName != b.StackName {
+		return a.StackName < b.StackName
+	}
+	return a.Name < b.Name
+}
+
+func lessContainer(a, b *Container) bool {
+	if a.CreateIndex != b.CreateIndex {
+		return a.CreateIndex < b.CreateIndex
+	}
+	if a.UUID != b.UUID {
+		return a.UUID < b.UUID
+	}
+	return a.Name < b.Name
+}
+
+func sortStacks(stacks []*Stack) {
+	sort.SliceStable(stacks, func(i, j int) bool { return lessStack(stacks[i], stacks[j]) })
+}
+
+func sortHosts(hosts []*Host) {
+	sort.SliceStable(hosts, func(i, j int) bool { return lessHost(hosts[i], hosts[j]) })
+}
+
+func sortServices(services []*Service) {
+	sort.SliceStable(services, func(i, j int) bool { return lessService(services[i], services[j]) })
+}
+
+func sortContainers(containers []*Container) {
+	sort.SliceStable(containers, func(i, j int) bool { return lessContainer(containers[i], containers[j]) })
+}
+
+// sortBy returns a copy of the list sorted by the given comma separated
+// keys. Keys are field names, which may be nested (e.g. 'Stack.Name') or
+// reference map entries (e.g. 'Labels.weight'), or the names of methods
+// without arguments (e.g. 'Healthy'). Keys prefixed with '-' sort
+// in descending order. Values of numeric fields, and strings that parse as
+// numbers, are compared numerically.
+// Example:
+//    {{range services | sortBy "Stack.Name,-CreateIndex"}}
+func sortBy(keys string, in interface{}) (interface{}, error) {
+	if in == nil {
+		return nil, fmt.Errorf("(sortBy) input is nil")
+	}
+
+	list := reflect.ValueOf(in)
+	if list.Kind() != reflect.Slice && list.Kind() != reflect.Array {
+		return nil, fmt.Errorf("(sortBy) invalid input type %T", in)
+	}
+
+	type sortKey struct {
+		path []string
+		desc bool
+	}
+	sortKeys := make([]sortKey, 0)
+	for _, key := range splitList(keys) {
+		k := sortKey{}
+		if strings.HasPrefix(key, "-") {
+			k.desc = true
+			key = key[1:]
+		}
+		k.path = strings.Split(key, ".")
+		sortKeys = append(sortKeys, k)
+	}
+	if len(sortKeys) == 0 {
+		return nil, fmt.Errorf("(sortBy) no keys given")
+	}
+
+	n := list.Len()
+	values := make([][]interface{}, n)
+	for i := 0; i < n; i++ {
+		values[i] = make([]interface{}, len(sortKeys))
+		for j, k := range sortKeys {
+			v, err := fieldValue(list.Index(i), k.path)
+			if err != nil {
+				return nil, fmt.Errorf("(sortBy) %v", err)
+			}
+			values[i][j] = v
+		}
+	}
+
+	index := make([]int, n)
+	for i := range index {
+		index[i] = i
+	}
+	sort.SliceStable(index, func(a, b int) bool {
+		for j, k := range sortKeys {
+			c := compareValues(values[index[a]][j], values[index[b]][j])
+			if c == 0 {
+				continue
+			}
+			if k.desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+
+	sorted := reflect.MakeSlice(reflect.SliceOf(list.Type().Elem()), n, n)
+	for i, idx := range index {
+		sorted.Index(i).Set(list.Index(idx))
+	}
+	return sorted.Interface(), nil
+}
+
+// fieldValue resolves the path of field names, methods and map keys on v.
+// Missing map entries and nil pointers resolve to nil.
+func fieldValue(v reflect.Value, path []string) (interface{}, error) {
+	for _, name := range path {
+		for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return nil, nil
+			}
+			v = v.Elem()
+		}
+
+		switch v.Kind() {
+		case reflect.Struct:
+			if f, ok := v.Type().FieldByName(name); ok {
+				if f.PkgPath != "" {
+					return nil, fmt.Errorf("field %s of %s is unexported", name, v.Type())
+				}
+				v = v.FieldByIndex(f.Index)
+				break
+			}
+			m, err := callMethod(v, name)
+			if err != nil {
+				return nil, err
+			}
+			v = m
+		case reflect.Map:
+			if v.Type().Key().Kind() != reflect.String {
+				return nil, fmt.Errorf("can't look up %s in %s", name, v.Type())
+			}
+			v = v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+			if !v.IsValid() {
+				return nil, nil
+			}
+		default:
+			return nil, fmt.Errorf("can't look up %s in %s", name, v.Type())
+		}
+	}
+
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	if !v.CanInterface() {
+		return nil, fmt.Errorf("%s is not accessible", strings.Join(path, "."))
+	}
+	return v.Interface(), nil
+}
+
+// callMethod calls the method name of the struct v, which must take no
+// arguments and return a value and optionally an error.
+func callMethod(v reflect.Value, name string) (reflect.Value, error) {
+	m := v.MethodByName(name)
+	if !m.IsValid() && v.CanAddr() {
+		m = v.Addr().MethodByName(name)
+	}
+	if !m.IsValid() {
+		return reflect.Value{}, fmt.Errorf("%s has no field or method %s", v.Type(), name)
+	}
+
+	mt := m.Type()
+	errorType := reflect.TypeOf((*error)(nil)).Elem()
+	if mt.NumIn() != 0 || mt.NumOut() == 0 || mt.NumOut() > 2 || (mt.NumOut() == 2 && mt.Out(1) != errorType) {
+		return reflect.Value{}, fmt.Errorf("method %s of %s can't be used as key", name, v.Type())
+	}
+
+	out := m.Call(nil)
+	if len(out) == 2 && !out[1].IsNil() {
+		return reflect.Value{}, fmt.Errorf("error calling %s: %v", name, out[1].Interface())
+	}
+	return out[0], nil
+}
+
+// compareValues compares two sort values. Numbers are compared
+// numerically, everything else by its string representation. nil sorts
+// first.
+func compareValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+
+	fa, okA := toFloat(a)
+	fb, okB := toFloat(b)
+	if okA && okB {
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	case reflect.String:
+		f, err := strconv.ParseFloat(rv.String(), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
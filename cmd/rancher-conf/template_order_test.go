@@ -0,0 +1,157 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/finboxio/go-rancher-metadata/metadata"
+)
+
+func newTestService(uuid, stack, name string, createIndex int, labels LabelMap) *Service {
+	return &Service{
+		Service: metadata.Service{UUID: uuid, StackName: stack, Name: name, CreateIndex: createIndex},
+		Labels:  labels,
+	}
+}
+
+func serviceNames(services []*Service) []string {
+	names := make([]string, 0)
+	for _, s := range services {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+func TestSortBy(t *testing.T) {
+	services := []*Service{
+		newTestService("u3", "web", "b", 2, LabelMap{"weight": "10"}),
+		newTestService("u1", "db", "a", 3, LabelMap{"weight": "9"}),
+		newTestService("u2", "web", "c", 1, nil),
+		newTestService("u4", "db", "d", 3, LabelMap{"weight": "x"}),
+	}
+
+	tests := []struct {
+		name    string
+		keys    string
+		in      interface{}
+		want    []string
+		wantErr bool
+	}{
+		{"field", "Name", services, []string{"a", "b", "c", "d"}, false},
+		{"descending", "-Name", services, []string{"d", "c", "b", "a"}, false},
+		{"numeric field", "CreateIndex", services, []string{"c", "b", "a", "d"}, false},
+		{"several keys", "StackName,-CreateIndex,Name", services, []string{"a", "d", "b", "c"}, false},
+		{"stable", "StackName", services, []string{"a", "d", "b", "c"}, false},
+		// numbers in strings compare numerically, missing entries first
+		{"map entry", "Labels.weight", services, []string{"c", "a", "b", "d"}, false},
+		{"spaces in keys", " -CreateIndex , Name ", services, []string{"a", "d", "b", "c"}, false},
+		{"unknown field", "Nope", services, nil, true},
+		{"unexported field", "version", services, nil, true},
+		{"no keys", " , ", services, nil, true},
+		{"nil", "Name", nil, nil, true},
+		{"not a list", "Name", services[0], nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sortBy(tt.keys, tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sortBy(%q) error = %v, wantErr %v", tt.keys, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if names := serviceNames(got.([]*Service)); !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("sortBy(%q) = %v, want %v", tt.keys, names, tt.want)
+			}
+		})
+	}
+
+	if names := serviceNames(services); !reflect.DeepEqual(names, []string{"b", "a", "c", "d"}) {
+		t.Errorf("sortBy modified its input: %v", names)
+	}
+}
+
+func TestSortByMethod(t *testing.T) {
+	ports := func(version int) []ServicePort {
+		return []ServicePort{
+			{PublicPort: "8080", InternalPort: "80", version: version},
+			{PublicPort: "443", InternalPort: "443", version: version},
+			{PublicPort: "9000", InternalPort: "9000", version: version},
+		}
+	}
+
+	got, err := sortBy("Public", ports(contextV2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := make([]string, 0)
+	for _, p := range got.([]ServicePort) {
+		public = append(public, p.PublicPort)
+	}
+	if want := []string{"443", "8080", "9000"}; !reflect.DeepEqual(public, want) {
+		t.Errorf("sortBy(\"Public\") = %v, want %v", public, want)
+	}
+
+	if _, err := sortBy("Public", ports(contextV1)); err == nil {
+		t.Error("sortBy(\"Public\") ignored the error of the method")
+	}
+}
+
+func TestSortServices(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []*Service
+		want     []string
+	}{
+		{
+			"by UUID",
+			[]*Service{
+				newTestService("u2", "a", "x", 1, nil),
+				newTestService("u1", "b", "y", 2, nil),
+			},
+			[]string{"y", "x"},
+		},
+		{
+			"ties by stack and name",
+			[]*Service{
+				newTestService("", "b", "x", 0, nil),
+				newTestService("", "a", "z", 0, nil),
+				newTestService("", "a", "y", 0, nil),
+			},
+			[]string{"y", "z", "x"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sortServices(tt.services)
+			if names := serviceNames(tt.services); !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("sortServices() = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareValues(t *testing.T) {
+	tests := []struct {
+		a, b interface{}
+		want int
+	}{
+		{nil, nil, 0},
+		{nil, "a", -1},
+		{"a", nil, 1},
+		{2, 10, -1},
+		{"2", "10", -1},
+		{"10", 9.5, 1},
+		{"b", "a", 1},
+		{"a10", "a2", -1},
+		{uint(3), 3, 0},
+	}
+
+	for _, tt := range tests {
+		if got := compareValues(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareValues(%v, %v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+)
+
+// hasProjection returns true if the template only sees a part of the
+// context.
+func (t Template) hasProjection() bool {
+	return len(t.Stacks) > 0 || len(t.Services) > 0
+}
+
+// project returns a context reduced to the given stacks and services.
+// Services are identified as 'stack-name/service-name' or
+// 'service-name[.stack-name]', see parseServiceRef. Hosts and stacks are copied so that they only list the
+// containers and services of the projection. References between objects,
+// e.g. from a container to its host, still point to the full context.
+func (c *TemplateContext) project(stacks, services []string) *TemplateContext {
+	selected := func(s *Service) bool {
+		for _, name := range stacks {
+			if strings.EqualFold(s.Stack.Name, name) {
+				return true
+			}
+		}
+		for _, identifier := range services {
+			service, stack := parseServiceRef(identifier, c.Self.stackName())
+			if strings.EqualFold(s.Name, service) && strings.EqualFold(s.Stack.Name, stack) {
+				return true
+			}
+		}
+		return false
+	}
+
+	p := &TemplateContext{
+		Services:   make([]*Service, 0),
+		Containers: make([]*Container, 0),
+		Hosts:      make([]*Host, 0, len(c.Hosts)),
+		Stacks:     make([]*Stack, 0),
+		Self:       c.Self,
+		Derived:    c.Derived,
+
+		MetadataVersion: c.MetadataVersion,
+		Environments:    c.Environments,
+	}
+
+	serviceSet := make(map[*Service]bool)
+	for _, s := range c.Services {
+		if selected(s) {
+			p.Services = append(p.Services, s)
+			serviceSet[s] = true
+		}
+	}
+
+	for _, st := range c.Stacks {
+		projected := *st
+		projected.Services = make([]*Service, 0)
+		for _, s := range st.Services {
+			if serviceSet[s] {
+				projected.Services = append(projected.Services, s)
+			}
+		}
+		if len(projected.Services) > 0 || containsFold(stacks, st.Name) {
+			p.Stacks = append(p.Stacks, &projected)
+		}
+	}
+
+	containerSet := make(map[*Container]bool)
+	for _, ct := range c.Containers {
+		if ct.Service != nil && serviceSet[ct.Service] {
+			p.Containers = append(p.Containers, ct)
+			containerSet[ct] = true
+		}
+	}
+
+	for _, h := range c.Hosts {
+		projected := *h
+		projected.Containers = make([]*Container, 0)
+		for _, ct := range h.Containers {
+			if containerSet[ct] {
+				projected.Containers = append(projected.Containers, ct)
+			}
+		}
+		p.Hosts = append(p.Hosts, &projected)
+	}
+
+	return p
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
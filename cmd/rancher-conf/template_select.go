@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// name returns the name of the template used by --only and --skip, which
+// defaults to its source.
+func (t Template) name() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return t.Source
+}
+
+// selectTemplates returns the templates that are listed in only, or all
+// templates if only is empty, without the templates listed in skip.
+// Templates are identified by name or source.
+func selectTemplates(templates []Template, only, skip []string) ([]Template, error) {
+	for _, name := range append(append([]string{}, only...), skip...) {
+		if findTemplate(templates, name) < 0 {
+			return nil, fmt.Errorf("Unknown template '%s'", name)
+		}
+	}
+
+	selected := make([]Template, 0, len(templates))
+	for _, t := range templates {
+		if len(only) > 0 && !t.matchesName(only) {
+			continue
+		}
+		if t.matchesName(skip) {
+			continue
+		}
+		selected = append(selected, t)
+	}
+	return selected, nil
+}
+
+func findTemplate(templates []Template, name string) int {
+	for i, t := range templates {
+		if t.matchesName([]string{name}) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t Template) matchesName(names []string) bool {
+	return containsString(names, t.name()) || containsString(names, t.Source)
+}
+
+// enabledFor returns true if the template is enabled for the container
+// running rancher-conf, i.e. enabled-when-label is not set or matches a
+// label of its host or service.
+func (t Template) enabledFor(self Self) bool {
+	if t.EnabledWhen == "" {
+		return true
+	}
+	if self.Host != nil && labelMatches(self.Host.Labels, t.EnabledWhen) {
+		return true
+	}
+	return self.Service != nil && labelMatches(self.Service.Labels, t.EnabledWhen)
+}
+
+// labelMatches returns true if the labels match the selector, given either
+// as 'key' or as 'key=value'.
+func labelMatches(labels LabelMap, selector string) bool {
+	if i := strings.Index(selector, "="); i >= 0 {
+		value, ok := labels[selector[:i]]
+		return ok && value == selector[i+1:]
+	}
+	_, ok := labels[selector]
+	return ok
+}
@@ -1,6 +1,10 @@
 package main
 
-import "github.com/finboxio/go-rancher-metadata/metadata"
+import (
+  "strings"
+
+  "github.com/finboxio/go-rancher-metadata/metadata"
+)
 
 type Self struct {
   Stack     *Stack
@@ -9,6 +13,66 @@ type Self struct {
   Host      *Host
 }
 
+// Peers returns the other containers of the service of the current
+// container.
+func (s Self) Peers() []*Container {
+  if s.Service == nil {
+    return make([]*Container, 0)
+  }
+  return otherContainers(s.Service.Containers, s.Container)
+}
+
+// Siblings returns the other containers of the deployment unit of the
+// current container, i.e. its primary container and sidekicks.
+func (s Self) Siblings() []*Container {
+  if s.Container == nil {
+    return make([]*Container, 0)
+  }
+  primary := s.Container
+  if primary.Parent != nil {
+    primary = primary.Parent
+  }
+  unit := append([]*Container{primary}, primary.Sidekicks...)
+  return otherContainers(unit, s.Container)
+}
+
+// Neighbors returns the other containers on the host of the current
+// container.
+func (s Self) Neighbors() []*Container {
+  if s.Host == nil {
+    return make([]*Container, 0)
+  }
+  return otherContainers(s.Host.Containers, s.Container)
+}
+
+// ContainersOfService returns the containers on the host that belong to
+// the given service, identified as 'stack-name/service-name' or
+// 'service-name[.stack-name]'. Without stack name, services of all stacks
+// match.
+func (h *Host) ContainersOfService(ref string) []*Container {
+  service, stack := parseServiceRef(ref, "")
+  result := make([]*Container, 0)
+  for _, c := range h.Containers {
+    if c.Service == nil || !strings.EqualFold(c.Service.Name, service) {
+      continue
+    }
+    if stack == "" || (c.Service.Stack != nil && strings.EqualFold(c.Service.Stack.Name, stack)) {
+      result = append(result, c)
+    }
+  }
+  return result
+}
+
+func otherContainers(containers []*Container, self *Container) []*Container {
+  result := make([]*Container, 0)
+  for _, c := range containers {
+    if c != self {
+      result = append(result, c)
+    }
+  }
+  return result
+}
+
 type Stack struct {
   metadata.Stack
   Services      []*Service
@@ -33,11 +97,20 @@ type Service struct {
   Labels        LabelMap
   Links         LabelMap
   Metadata      MetadataMap
+  // linked services by alias, see Linked
+  linked        map[string]*Service
+  // name in the internal DNS, '<service>.<stack>.rancher.internal'
+  Fqdn          string
+  // FQDN set in the metadata, e.g. by the external DNS service
+  ExternalFqdn  string
 
   Primary       bool
   Sidekick      bool
   Stack         *Stack
   Parent        *Service
+
+  // context version the service has been built for
+  version       int
 }
 
 // Container represents a container belonging to a Rancher Service.
@@ -47,6 +120,8 @@ type Container struct {
   Ports         []ServicePort
   Labels        LabelMap
   Links         LabelMap
+  // name in the internal DNS, '<container>.rancher.internal'
+  Fqdn          string
 
   Primary       bool
   Sidekick      bool
@@ -54,14 +129,21 @@ type Container struct {
   Host          *Host
   Parent        *Container
   Sidekicks     []*Container
+
+  // context version the container has been built for
+  version       int
 }
 
-// ServicePort represents a port exposed by a service
+// ServicePort represents a port exposed by a service. The typed accessors
+// of context version 2 are defined in context_version.go.
 type ServicePort struct {
   BindAddress  string
   PublicPort   string
   InternalPort string
   Protocol     string
+
+  // context version the port has been built for
+  version      int
 }
 
 type ParsedUrl struct {
@@ -118,3 +200,33 @@ func (m MetadataMap) GetValue(key string, v ...interface{}) interface{} {
 
   return ""
 }
+
+// Path returns the value at the given path of nested keys separated by
+// dots, e.g. 'upstream.port', or nil if it doesn't exist.
+func (m MetadataMap) Path(path string) interface{} {
+  val, _ := m.lookup(path)
+  return val
+}
+
+func (m MetadataMap) lookup(path string) (interface{}, bool) {
+  var current interface{} = map[string]interface{}(m)
+  for _, key := range strings.Split(path, ".") {
+    switch tree := current.(type) {
+    case map[string]interface{}:
+      val, ok := tree[key]
+      if !ok {
+        return nil, false
+      }
+      current = val
+    case MetadataMap:
+      val, ok := tree[key]
+      if !ok {
+        return nil, false
+      }
+      current = val
+    default:
+      return nil, false
+    }
+  }
+  return current, true
+}
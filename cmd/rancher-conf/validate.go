@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// validators parse rendered content in the formats supported by the
+// validate-format option.
+var validators = map[string]func(content []byte) error{
+	"json": validateJSON,
+	"yaml": validateYAML,
+	"toml": validateTOML,
+	"xml":  validateXML,
+}
+
+// checkValidateFormat returns an error if format is not supported.
+func checkValidateFormat(format string) error {
+	if _, ok := validators[strings.ToLower(format)]; format != "" && !ok {
+		return fmt.Errorf("Unknown validate-format '%s'", format)
+	}
+	return nil
+}
+
+// validateContent parses rendered content in the given format. An empty
+// format disables validation.
+func validateContent(content []byte, format string) error {
+	if format == "" {
+		return nil
+	}
+	validate, ok := validators[strings.ToLower(format)]
+	if !ok {
+		return fmt.Errorf("Unknown validate-format '%s'", format)
+	}
+	if err := validate(content); err != nil {
+		return fmt.Errorf("Rendered content is not valid %s: %v", strings.ToUpper(format), err)
+	}
+	return nil
+}
+
+func validateJSON(content []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(content))
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("unexpected data after top-level value")
+	}
+	return nil
+}
+
+// validateYAML parses all documents of a YAML stream.
+func validateYAML(content []byte) error {
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var v interface{}
+		err := dec.Decode(&v)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func validateTOML(content []byte) error {
+	var v map[string]interface{}
+	_, err := toml.Decode(string(content), &v)
+	return err
+}
+
+func validateXML(content []byte) error {
+	dec := xml.NewDecoder(bytes.NewReader(content))
+	root := false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if _, ok := tok.(xml.StartElement); ok {
+			root = true
+		}
+	}
+	if !root {
+		return fmt.Errorf("no root element")
+	}
+	return nil
+}
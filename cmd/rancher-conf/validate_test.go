@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		content string
+		wantErr bool
+	}{
+		{"no format", "", "{", false},
+		{"unknown format", "ini", "a = 1", true},
+
+		{"json object", "json", `{"a": [1, 2]}`, false},
+		{"json upper case format", "JSON", `{"a": 1}`, false},
+		{"json trailing whitespace", "json", "{}\n", false},
+		{"json truncated", "json", `{"a": [1, 2`, true},
+		{"json trailing data", "json", `{} {}`, true},
+		{"json empty", "json", "", true},
+
+		{"yaml mapping", "yaml", "a: 1\nb: [1, 2]\n", false},
+		{"yaml documents", "yaml", "a: 1\n---\nb: 2\n", false},
+		{"yaml empty", "yaml", "", false},
+		{"yaml bad indentation", "yaml", "a:\n  b: 1\n c: 2\n", true},
+		{"yaml invalid second document", "yaml", "a: 1\n---\nb: [1\n", true},
+
+		{"toml", "toml", "a = 1\n[b]\nc = \"d\"\n", false},
+		{"toml missing value", "toml", "a =\n", true},
+		{"toml duplicate key", "toml", "a = 1\na = 2\n", true},
+
+		{"xml", "xml", `<?xml version="1.0"?><a><b c="d"/></a>`, false},
+		{"xml unclosed", "xml", `<a><b></a>`, true},
+		{"xml no root", "xml", `<?xml version="1.0"?>`, true},
+		{"xml text only", "xml", `text`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateContent([]byte(tt.content), tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateContent(%q, %s) error = %v, wantErr %v", tt.content, tt.format, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckValidateFormat(t *testing.T) {
+	tests := []struct {
+		format  string
+		wantErr bool
+	}{
+		{"", false},
+		{"json", false},
+		{"YAML", false},
+		{"toml", false},
+		{"xml", false},
+		{"ini", true},
+	}
+
+	for _, tt := range tests {
+		if err := checkValidateFormat(tt.format); (err != nil) != tt.wantErr {
+			t.Errorf("checkValidateFormat(%q) error = %v, wantErr %v", tt.format, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+	log "github.com/sirupsen/logrus"
+)
+
+// parseWaitFor compiles the wait-for expression into a template that
+// renders 'true' if the expression is true.
+func (r *runner) parseWaitFor() (*template.Template, error) {
+	source := "{{if " + r.Config.WaitFor + "}}true{{end}}"
+	tmpl, err := template.New("wait-for").Funcs(r.waitForFuncs(&TemplateContext{})).Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid wait-for expression: %v", err)
+	}
+	return tmpl, nil
+}
+
+// waitForFuncs returns the template functions for the context with the
+// global context-version.
+func (r *runner) waitForFuncs(ctx *TemplateContext) template.FuncMap {
+	funcs := r.funcMap(ctx)
+	r.versionFuncs(Template{}, funcs)
+	return funcs
+}
+
+// waitForCondition delays the first render until the wait-for expression
+// is true for the context, e.g. 'ge (len (healthy (service "galera.db").Containers)) 3'.
+// It is evaluated again whenever the metadata version changes. maxWait
+// limits the duration of a single metadata request.
+func (r *runner) waitForCondition(maxWait int, watchdog bool) error {
+	if r.Config.WaitFor == "" {
+		return nil
+	}
+
+	tmpl, err := r.parseWaitFor()
+	if err != nil {
+		return err
+	}
+
+	var deadline time.Time
+	if r.Config.WaitForTimeout > 0 {
+		deadline = time.Now().Add(time.Duration(r.Config.WaitForTimeout) * time.Second)
+	}
+
+	log.Infof("Waiting for '%s'", r.Config.WaitFor)
+	version, err := r.Client.GetVersion()
+	if err != nil {
+		return err
+	}
+
+	lastLog := time.Now()
+	for {
+		ctx, _, err := r.createContext()
+		if err != nil {
+			return err
+		}
+
+		// errors, e.g. of services that don't exist yet, count as false
+		buf := new(bytes.Buffer)
+		err = tmpl.Funcs(r.waitForFuncs(ctx)).Execute(buf, templateData{Vars: r.Config.Vars, Environments: ctx.Environments})
+		if err == nil && buf.String() == "true" {
+			log.Infof("Condition '%s' is true", r.Config.WaitFor)
+			return nil
+		}
+		if err != nil {
+			log.Debugf("Could not evaluate wait-for expression: %v", err)
+		}
+		if time.Since(lastLog) >= time.Minute {
+			log.Infof("Still waiting for '%s'", r.Config.WaitFor)
+			lastLog = time.Now()
+		}
+
+		wait := maxWait
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return fmt.Errorf("Timed out waiting for '%s'", r.Config.WaitFor)
+			}
+			if s := int((remaining + time.Second - 1) / time.Second); s < wait {
+				wait = s
+			}
+		}
+
+		if watchdog {
+			sdNotify(daemon.SdNotifyWatchdog)
+		}
+		if version, err = r.waitVersion(version, wait); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// watchPaths returns the paths watched by the templates, without
+// duplicates.
+func watchPaths(templates []Template) []string {
+	paths := make([]string, 0)
+	for _, t := range templates {
+		for _, p := range t.Watch {
+			if !containsString(paths, p) {
+				paths = append(paths, p)
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// fingerprint returns a checksum of the names, sizes and modification
+// times of a file or of all files below a directory. Paths that don't
+// exist have an empty fingerprint.
+func fingerprint(path string) string {
+	hash := md5.New()
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s %d %d %v\n", p, info.Size(), info.ModTime().UnixNano(), info.Mode())
+		return nil
+	})
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// changedWatchPaths returns the watched paths that changed since the last
+// call and remembers their current fingerprints.
+func (r *runner) changedWatchPaths() []string {
+	changed := make([]string, 0)
+	for _, p := range watchPaths(r.Config.Templates) {
+		current := fingerprint(p)
+		if previous, ok := r.watched[p]; ok && previous != current {
+			changed = append(changed, p)
+		}
+		r.watched[p] = current
+	}
+	return changed
+}
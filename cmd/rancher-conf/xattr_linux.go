@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const selinuxXattr = "security.selinux"
+
+// copyXattrs copies the extended attributes (including the SELinux label)
+// of src to dst. Attributes that can't be set, e.g. because the filesystem
+// of dst doesn't support them, are skipped.
+func copyXattrs(src, dst string) error {
+	size, err := syscall.Listxattr(src, nil)
+	if err != nil {
+		if err == syscall.ENOTSUP || err == syscall.ENOENT {
+			return nil
+		}
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(src, buf)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		attr := string(name)
+
+		vsize, err := syscall.Getxattr(src, attr, nil)
+		if err != nil {
+			log.Debugf("Could not read attribute %s of %s: %v", attr, src, err)
+			continue
+		}
+		value := make([]byte, vsize)
+		if vsize, err = syscall.Getxattr(src, attr, value); err != nil {
+			log.Debugf("Could not read attribute %s of %s: %v", attr, src, err)
+			continue
+		}
+
+		if err := syscall.Setxattr(dst, attr, value[:vsize], 0); err != nil {
+			log.Debugf("Could not copy attribute %s to %s: %v", attr, dst, err)
+		}
+	}
+
+	return nil
+}
+
+// setSELinuxLabel sets the SELinux security context of path.
+func setSELinuxLabel(path, label string) error {
+	return syscall.Setxattr(path, selinuxXattr, []byte(label), 0)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+// Extended attributes are only supported on Linux.
+func copyXattrs(src, dst string) error {
+	return nil
+}
+
+func setSELinuxLabel(path, label string) error {
+	return fmt.Errorf("SELinux labels are only supported on Linux")
+}